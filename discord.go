@@ -2,11 +2,14 @@ package main
 
 import (
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/google/uuid"
 	"github.com/tadeokondrak/irc"
 )
 
@@ -17,8 +20,56 @@ func getTimeFromSnowflake(snowflake string) time.Time {
 	return time.Unix(0, int64(unix)*1000000)
 }
 
-func addRecentlySentMessage(c *ircConn, channelID string, content string) {
-	c.recentlySentMessages[channelID] = append(c.recentlySentMessages[channelID], content)
+func getSnowflakeFromTime(t time.Time) string {
+	unix := uint64(t.UnixNano()/1000000) - 1420070400000
+	return strconv.FormatUint(unix<<22, 10)
+}
+
+// snowflakeLess reports whether snowflake a was created before snowflake b
+func snowflakeLess(a string, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+func sortMessages(messages []*discordgo.Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return snowflakeLess(messages[i].ID, messages[j].ID)
+	})
+}
+
+// sentMessage is a message we sent to Discord from this conn
+type sentMessage struct {
+	id      string
+	content string
+	echoed  bool // whether Discord already sent it back to us
+}
+
+// maxRecentlySentMessages is how many of our own messages are remembered per channel
+const maxRecentlySentMessages = 50
+
+const (
+	maxDiscordMessageLength = 2000 // characters
+	maxPasteMessages        = 3    // longer messages are uploaded as a file instead
+)
+
+func addRecentlySentMessage(c *ircConn, channelID string, content string) *sentMessage {
+	sent := &sentMessage{content: content}
+	c.recentlySentMessagesMutex.Lock()
+	defer c.recentlySentMessagesMutex.Unlock()
+	messages := append(c.recentlySentMessages[channelID], sent)
+	if len(messages) > maxRecentlySentMessages {
+		messages = messages[len(messages)-maxRecentlySentMessages:]
+	}
+	c.recentlySentMessages[channelID] = messages
+	return sent
+}
+
+func setRecentlySentMessageID(c *ircConn, sent *sentMessage, messageID string) {
+	c.recentlySentMessagesMutex.Lock()
+	sent.id = messageID
+	c.recentlySentMessagesMutex.Unlock()
 }
 
 func isRecentlySentMessage(c *ircConn, m *discordgo.Message) bool {
@@ -31,29 +82,159 @@ func isRecentlySentMessage(c *ircConn, m *discordgo.Message) bool {
 	if c.guildSession.selfUser.ID != m.Author.ID {
 		return false
 	}
-	if recentlySentMessages, exists := c.recentlySentMessages[m.ChannelID]; exists {
-		for index, recentMessage := range recentlySentMessages {
-			if m.Content == recentMessage && recentMessage != "" {
-				c.recentlySentMessages[m.ChannelID][index] = "" // remove the message from recently sent
-				return true
-			}
+	c.recentlySentMessagesMutex.Lock()
+	defer c.recentlySentMessagesMutex.Unlock()
+	for _, sent := range c.recentlySentMessages[m.ChannelID] {
+		if sent.echoed {
+			continue
+		}
+		// the gateway event can arrive before Discord has answered with the ID
+		if sent.id == m.ID || (sent.id == "" && sent.content != "" && sent.content == m.Content) {
+			sent.echoed = true
+			return true
 		}
 	}
 	return false
 }
 
+// getOwnMessageID finds one of our own messages in a channel. An empty reference means the
+// latest one, otherwise it's a message ID or the last few digits of one we sent recently.
+func getOwnMessageID(c *ircConn, channelID string, reference string) string {
+	c.recentlySentMessagesMutex.Lock()
+	messages := c.recentlySentMessages[channelID]
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].id == "" {
+			continue
+		}
+		if reference == "" || messages[i].id == reference || (len(reference) >= 3 && strings.HasSuffix(messages[i].id, reference)) {
+			c.recentlySentMessagesMutex.Unlock()
+			return messages[i].id
+		}
+	}
+	c.recentlySentMessagesMutex.Unlock()
+
+	if reference != "" {
+		message, err := c.getMessage(channelID, reference)
+		if err != nil || message.Author == nil || message.Author.ID != c.selfUser.ID {
+			return ""
+		}
+		return message.ID
+	}
+
+	// we might have sent it from somewhere else, so look through the history
+	history, err := c.getHistoryBefore(channelID, "", "", 50)
+	if err != nil {
+		return ""
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Author != nil && history[i].Author.ID == c.selfUser.ID {
+			return history[i].ID
+		}
+	}
+	return ""
+}
+
+var (
+	patternLeadingMention = regexp.MustCompile(`^([^:\s]+): ?`)
+	patternMentionNick    = regexp.MustCompile(`^@[A-Za-z0-9\-[\]\\\x60{}|_]+`)
+	patternMentionChannel = regexp.MustCompile(`^#[A-Za-z0-9\-_#&/]+`)
+	patternMentionEmoji   = regexp.MustCompile(`^:[A-Za-z0-9_]{2,}:`)
+)
+
+// convertIRCMentionsToDiscord turns `nick1: nick2:` at the start of a message, and @nick, #channel, &role
+// and :emoji: anywhere in it, into Discord mentions. Code is left alone.
 func convertIRCMentionsToDiscord(c *ircConn, message string) (content string) {
-	// TODO: allow chained mentions (`user1: user2: `)
-	startMessageMentionRegex := regexp.MustCompile(`^([^:]+): ?`)
-	matches := startMessageMentionRegex.FindAllStringSubmatchIndex(message, -1)
-	if len(matches) == 0 {
-		return message
+	var builder strings.Builder
+	for {
+		match := patternLeadingMention.FindStringSubmatchIndex(message)
+		if match == nil {
+			break
+		}
+		discordID := c.guildSession.userMap.GetSnowflake(message[match[2]:match[3]])
+		if discordID == "" {
+			break
+		}
+		builder.WriteString("<@" + discordID + "> ")
+		message = message[match[1]:]
+	}
+
+	for i := 0; i < len(message); {
+		rest := message[i:]
+		if length := getCodeLength(rest); length > 0 {
+			builder.WriteString(rest[:length])
+			i += length
+			continue
+		}
+		if i == 0 || isMentionBoundary(message[i-1]) {
+			if mention, length := convertIRCMentionToDiscord(c, rest); length > 0 {
+				builder.WriteString(mention)
+				i += length
+				continue
+			}
+		}
+		builder.WriteByte(rest[0])
+		i++
+	}
+	return builder.String()
+}
+
+// convertIRCMentionToDiscord converts the mention at the start of text, returning how much of text it was
+func convertIRCMentionToDiscord(c *ircConn, text string) (mention string, length int) {
+	switch text[0] {
+	case '@':
+		nick := patternMentionNick.FindString(text)
+		if discordID := c.guildSession.userMap.GetSnowflake(strings.TrimPrefix(nick, "@")); discordID != "" {
+			return "<@" + discordID + ">", len(nick)
+		}
+	case '#':
+		channelName := patternMentionChannel.FindString(text)
+		if discordID := c.guildSession.channelMap.GetSnowflake(channelName); discordID != "" {
+			return "<#" + discordID + ">", len(channelName)
+		}
+	case '&':
+		// role names can have spaces, so take the longest one the text starts with
+		for roleName, discordID := range c.guildSession.roleMap.GetSnowflakeMap() {
+			end := 1 + len(roleName)
+			if roleName == "" || !strings.HasPrefix(text[1:], roleName) || end <= length || (end < len(text) && isWordByte(text[end])) {
+				continue
+			}
+			mention, length = "<@&"+discordID+">", end
+		}
+	case ':':
+		emoji := patternMentionEmoji.FindString(text)
+		if emoji == "" || c.guild == nil {
+			break
+		}
+		for _, guildEmoji := range c.guild.Emojis {
+			if guildEmoji.Name == emoji[1:len(emoji)-1] {
+				return guildEmoji.MessageFormat(), len(emoji)
+			}
+		}
 	}
-	discordID := c.guildSession.userMap.GetSnowflake(message[matches[0][2]:matches[0][3]])
-	if discordID != "" {
-		return "<@" + discordID + "> " + message[matches[0][1]:]
+	return
+}
+
+// getCodeLength returns the length of the code span or block at the start of text, or 0 if there isn't one
+func getCodeLength(text string) int {
+	if strings.HasPrefix(text, formatMonospace) {
+		if end := strings.Index(text[1:], formatMonospace); end >= 0 {
+			return end + 2
+		}
+		return 0
+	}
+
+	run := len(text) - len(strings.TrimLeft(text, "`"))
+	if run == 0 {
+		return 0
 	}
-	return message
+	if end := strings.Index(text[run:], text[:run]); end >= 0 {
+		return run + end + run
+	}
+	return 0
+}
+
+func isMentionBoundary(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || strings.IndexByte("([{\"'*_~|", b) >= 0
 }
 
 func sendMessageFromDiscordToIRC(date time.Time, c *ircConn, m *discordgo.Message, prefixString string, batchTag string) {
@@ -65,39 +246,285 @@ func sendMessageFromDiscordToIRC(date time.Time, c *ircConn, m *discordgo.Messag
 	}
 
 	ircChannel := c.guildSession.channelMap.GetName(m.ChannelID)
-	c.channelsMutex.Lock()
-	if c.guildSession.guildSessionType == guildSessionGuild && !c.channels[m.ChannelID] {
-		c.channelsMutex.Unlock()
+	if queryTarget := c.getQueryTarget(m); queryTarget != "" {
+		ircChannel = queryTarget
+	} else if batchTag == "" && !c.isJoined(m.ChannelID) { // history can be asked for without joining
 		return
 	}
-	c.channelsMutex.Unlock()
 
 	if ircChannel == "" || isRecentlySentMessage(c, m) || m.Author == nil {
 		return
 	}
 
 	tags := irc.Tags{
-		"time": date.Format("2006-01-02T15:04:05.000Z"),
+		"time":  date.Format("2006-01-02T15:04:05.000Z"),
+		"msgid": m.ID,
 	}
 
 	if batchTag != "" {
 		tags["batch"] = batchTag
 	}
 
+	if m.Type == messageTypeReply && m.MessageReference != nil {
+		tags["+draft/reply"] = m.MessageReference.MessageID
+		if !c.user.supportedCapabilities["message-tags"] {
+			prefixString += getReplyPrefix(c, m)
+		}
+	}
+
 	nick := c.guildSession.getNick(m.Author)
 
-	content := prefixString + convertDiscordMessageToIRC(m, c)
-	if content != "" {
+	content, isAction := convertDiscordMessageToIRC(m, c)
+	if content == "" {
+		return
+	}
+
+	maxBytes := c.getPRIVMSGLength(tags, nick, nick, m.Author.ID, ircChannel)
+	var lines []string
+	if isAction {
+		// only the action itself is sent as an ACTION, not the prefix
+		if prefixString != "" {
+			for _, msg := range strings.Split(strings.TrimSuffix(prefixString, "\n"), "\n") {
+				lines = append(lines, splitIRCLine(msg, maxBytes, false)...)
+			}
+		}
+		lines = append(lines, splitIRCAction(content, maxBytes)...)
+	} else {
+		content = prefixString + content
 		for _, msg := range strings.Split(content, "\n") {
-			for _, line := range splitSubN(msg, 350) {
-				c.sendPRIVMSG(tags, nick, nick, m.Author.ID, ircChannel, line)
+			lines = append(lines, splitIRCLine(msg, maxBytes, false)...)
+		}
+	}
+	if len(lines) > 1 && c.user.supportedCapabilities["draft/multiline"] && c.user.supportedCapabilities["batch"] && !isAction {
+		sendMultilineMessageFromDiscordToIRC(c, tags, nick, m.Author.ID, ircChannel, content)
+		return
+	}
+	for _, line := range lines {
+		c.sendPRIVMSG(tags, nick, nick, m.Author.ID, ircChannel, line)
+	}
+}
+
+// sendMultilineMessageFromDiscordToIRC sends a message as a draft/multiline batch. Lines that are too
+// long are split without repeating their formatting, so the client can join them back together.
+func sendMultilineMessageFromDiscordToIRC(c *ircConn, tags irc.Tags, nick string, userID string, ircChannel string, content string) {
+	batchTag := uuid.New().String()
+	lineTags := irc.Tags{"batch": batchTag}
+	concatTags := irc.Tags{"batch": batchTag, "draft/multiline-concat": ""}
+	maxBytes := c.getPRIVMSGLength(concatTags, nick, nick, userID, ircChannel)
+
+	c.sendMultilineBATCH(tags, nick, nick, userID, batchTag, ircChannel)
+	for _, msg := range strings.Split(content, "\n") {
+		if msg == "" { // blank lines are part of the message too
+			c.sendPRIVMSG(lineTags, nick, nick, userID, ircChannel, "")
+			continue
+		}
+		for i, line := range splitIRCLine(msg, maxBytes, true) {
+			if i == 0 {
+				c.sendPRIVMSG(lineTags, nick, nick, userID, ircChannel, line)
+			} else {
+				c.sendPRIVMSG(concatTags, nick, nick, userID, ircChannel, line)
+			}
+		}
+	}
+	c.sendBATCH(false, batchTag)
+}
+
+// getSystemMessageAction describes what happened in a system message, to be sent as an ACTION from its author.
+// It's empty for normal messages.
+func getSystemMessageAction(c *ircConn, m *discordgo.Message) string {
+	var mentioned string
+	if len(m.Mentions) > 0 {
+		mentioned = c.getNick(m.Mentions[0])
+	}
+
+	switch m.Type {
+	case discordgo.MessageTypeRecipientAdd:
+		return "added " + mentioned + " to the group"
+	case discordgo.MessageTypeRecipientRemove:
+		if len(m.Mentions) == 0 || (m.Author != nil && m.Mentions[0].ID == m.Author.ID) {
+			return "left the group"
+		}
+		return "removed " + mentioned + " from the group"
+	case discordgo.MessageTypeCall:
+		return "started a call"
+	case discordgo.MessageTypeChannelNameChange:
+		return "changed the channel name to " + m.Content
+	case discordgo.MessageTypeChannelIconChange:
+		return "changed the channel icon"
+	case discordgo.MessageTypeChannelPinnedMessage:
+		if m.MessageReference != nil {
+			if pinned, err := c.getMessage(m.ChannelID, m.MessageReference.MessageID); err == nil && pinned.Author != nil {
+				return "pinned a message from " + c.getNick(pinned.Author) + ": " + getMessageSnippet(c, pinned)
+			}
+		}
+		return "pinned a message to this channel"
+	case discordgo.MessageTypeGuildMemberJoin:
+		return "joined the server"
+	case discordgo.MessageTypeUserPremiumGuildSubscription:
+		return "boosted the server"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierOne:
+		return "boosted the server, which reached level 1"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierTwo:
+		return "boosted the server, which reached level 2"
+	case discordgo.MessageTypeUserPremiumGuildSubscriptionTierThree:
+		return "boosted the server, which reached level 3"
+	case discordgo.MessageTypeChannelFollowAdd:
+		return "added " + m.Content + " to this channel's followers"
+	case messageTypeThreadCreated:
+		if m.MessageReference != nil {
+			if threadName := c.guildSession.channelMap.GetName(m.MessageReference.ChannelID); threadName != "" {
+				return "started a thread: " + threadName
 			}
 		}
+		return "started a thread: " + m.Content
+	case messageTypeThreadStarterMessage:
+		if m.MessageReference != nil {
+			if starter, err := c.getMessage(m.MessageReference.ChannelID, m.MessageReference.MessageID); err == nil {
+				return "started this thread from: " + getMessageSnippet(c, starter)
+			}
+		}
+		return "started this thread"
+	}
+	return ""
+}
+
+// getMessageSnippet returns the first line of a message, shortened to fit in a notice
+func getMessageSnippet(c *ircConn, m *discordgo.Message) string {
+	content, _ := convertDiscordMessageToIRC(m, c)
+	snippet := strings.Split(content, "\n")[0]
+	if runes := []rune(snippet); len(runes) > 50 {
+		snippet = string(runes[:50]) + "…"
+	}
+	return snippet + "\x0f"
+}
+
+// getReplyPrefix quotes the message being replied to, for clients that can't see +draft/reply
+func getReplyPrefix(c *ircConn, m *discordgo.Message) string {
+	repliedMessage, err := c.getMessage(m.MessageReference.ChannelID, m.MessageReference.MessageID)
+	if err != nil || repliedMessage.Author == nil {
+		return "\x0314> replying to a deleted message\x0f\n"
+	}
+	return "\x0314> replying to " + c.getNick(repliedMessage.Author) + ": \x0f" + getMessageSnippet(c, repliedMessage) + "\n"
+}
+
+// convertDiscordEmojiToIRC returns unicode emoji as-is and custom emoji as :name:
+func convertDiscordEmojiToIRC(emoji discordgo.Emoji) string {
+	if emoji.ID == "" {
+		return emoji.Name
+	}
+	return ":" + emoji.Name + ":"
+}
+
+// convertIRCEmojiToDiscord returns the identifier the reaction API expects, name:id for custom emoji
+func convertIRCEmojiToDiscord(c *ircConn, emoji string) string {
+	if len(emoji) < 3 || !strings.HasPrefix(emoji, ":") || !strings.HasSuffix(emoji, ":") || c.guild == nil {
+		return emoji
+	}
+	name := emoji[1 : len(emoji)-1]
+	for _, guildEmoji := range c.guild.Emojis {
+		if guildEmoji.Name == name {
+			return guildEmoji.APIName()
+		}
+	}
+	return emoji
+}
+
+func sendReactionFromDiscordToIRC(c *ircConn, r *discordgo.MessageReaction, removed bool) {
+	if c.guildSession.selfUser != nil && r.UserID == c.guildSession.selfUser.ID && !c.user.supportedCapabilities["echo-message"] {
+		return
+	}
+
+	ircChannel := c.guildSession.channelMap.GetName(r.ChannelID)
+	if !c.isJoined(r.ChannelID) {
+		return
+	}
+
+	if ircChannel == "" {
+		return
+	}
+
+	user, err := c.getUser(r.UserID)
+	if err != nil {
+		user, err = c.session.User(r.UserID)
+		if err != nil {
+			return
+		}
+	}
+	nick := c.getNick(user)
+	emoji := convertDiscordEmojiToIRC(r.Emoji)
+
+	if c.user.supportedCapabilities["message-tags"] {
+		tags := irc.Tags{
+			"+draft/reply": r.MessageID,
+		}
+		if removed {
+			tags.Set("+draft/unreact", emoji)
+		} else {
+			tags.Set("+draft/react", emoji)
+		}
+		c.sendTAGMSG(tags, nick, nick, user.ID, ircChannel)
+		return
+	}
+
+	if removed || *reactionFormat == "" {
+		return
+	}
+
+	message, err := c.getMessage(r.ChannelID, r.MessageID)
+	if err != nil {
+		return
+	}
+	c.sendChannelNOTICE(nick, nick, user.ID, ircChannel, strings.NewReplacer(
+		"$nick", nick,
+		"$emoji", emoji,
+		"$message", getMessageSnippet(c, message),
+	).Replace(*reactionFormat))
+}
+
+// sendMessagesFromDiscordToIRC sends a list of messages (oldest first) in a chathistory batch
+func sendMessagesFromDiscordToIRC(c *ircConn, target string, messages []*discordgo.Message) {
+	tag := uuid.New().String()
+	if c.user.supportedCapabilities["batch"] {
+		c.sendBATCH(true, tag, "chathistory", target)
+	}
+	for _, message := range messages {
+		date, err := message.Timestamp.Parse()
+		if err != nil {
+			continue
+		}
+		sendMessageFromDiscordToIRC(date, c, message, "", tag)
+	}
+	if c.user.supportedCapabilities["batch"] {
+		c.sendBATCH(false, tag)
+	}
+}
+
+// getAwayMessage returns why a user is away, or an empty string if they aren't
+func getAwayMessage(presence *discordgo.Presence) (message string) {
+	if presence == nil {
+		return ""
+	}
+	switch presence.Status {
+	case discordgo.StatusIdle:
+		message = "Idle"
+	case discordgo.StatusDoNotDisturb:
+		message = "Do not disturb"
+	case discordgo.StatusOffline, discordgo.StatusInvisible:
+		message = "Offline"
+	default:
+		return ""
+	}
+	if presence.Game != nil && presence.Game.Type == gameTypeCustomStatus && presence.Game.State != "" {
+		return presence.Game.State
 	}
+	return
 }
 
+// maxNickLength is the longest guild nickname Discord allows
+const maxNickLength = 32
+
 func isValidDiscordNick(nick string) bool {
-	return true
+	return nick != "" && len(nick) <= maxNickLength && getIRCNick(nick) == nick
 }
 
 func convertIRCMessageToDiscord(user *ircConn, ircMessage string) (discordMessage string) {
@@ -105,6 +532,116 @@ func convertIRCMessageToDiscord(user *ircConn, ircMessage string) (discordMessag
 	discordMessage = ircMessage
 	discordMessage = strings.TrimSpace(discordMessage)
 	discordMessage = actionRegex.ReplaceAllString(discordMessage, `*$1*`)
+	// formatting goes first, so mentions see code as Markdown and aren't split by formatting codes
+	discordMessage = convertIRCFormattingToMarkdown(discordMessage)
 	discordMessage = convertIRCMentionsToDiscord(user, discordMessage)
 	return discordMessage
 }
+
+// patternCodeLine matches lines that are indented, open or close a block, end a statement,
+// or are part of a Java, JavaScript, Python or Go stack trace
+var patternCodeLine = regexp.MustCompile(`^(?: {2,}|\t)\S|[{(\[]\s*$|^\s*[}\])]+[;,]?\s*$|(?:\)|=.*);\s*$|^\s+at \S+ ?\(.*\)\s*$|^\s*File ".*", line \d+|^Traceback \(most recent call last\):|^goroutine \d+ \[|^\s*#include\s*[<"]|^\s*(?:def|func|class) \w+.*[:({]\s*$`)
+
+// looksLikeCode reports whether at least half of the lines look like code or a stack trace
+func looksLikeCode(lines []string) bool {
+	matches := 0
+	for _, line := range lines {
+		if patternCodeLine.MatchString(line) {
+			matches++
+		}
+	}
+	return matches*2 >= len(lines)
+}
+
+// splitDiscordMessage splits a message into parts of at most maxLength characters, between lines or words where it can
+func splitDiscordMessage(content string, maxLength int) (parts []string) {
+	for utf8.RuneCountInString(content) > maxLength {
+		part := string([]rune(content)[:maxLength])
+		end := strings.LastIndex(part, "\n")
+		if end <= 0 {
+			end = strings.LastIndex(part, " ")
+		}
+		if end <= 0 {
+			end = len(part)
+		}
+		parts = append(parts, content[:end])
+		content = content[end:]
+		if content[0] == '\n' || content[0] == ' ' {
+			content = content[1:]
+		}
+	}
+	return append(parts, content)
+}
+
+// sendVisibilityChangeFromDiscordToIRC sends a JOIN or PART for a user who can now or can no longer view a channel.
+// If it's us, we're parted from the channel.
+func sendVisibilityChangeFromDiscordToIRC(c *ircConn, channel *discordgo.Channel, user *discordgo.User, visible bool) {
+	channelName := c.guildSession.getChannelName(channel)
+	if channelName == "" || !c.isJoined(channel.ID) {
+		return
+	}
+
+	if user.ID == c.selfUser.ID {
+		if !visible {
+			c.channelsMutex.Lock()
+			c.channels[channel.ID] = false
+			c.channelsMutex.Unlock()
+			c.sendPART("", "", "", channelName, "You can no longer view this channel")
+		}
+		return
+	}
+
+	nick := c.getNick(user)
+	if visible {
+		c.sendJOIN(nick, nick, user.ID, channelName)
+	} else {
+		c.sendPART(nick, nick, user.ID, channelName, "")
+	}
+}
+
+// sendMessageToQueries delivers a DM to the guild conns with a query open for it. If there
+// aren't any and no DM session conn to read it in, it opens one in every guild conn that knows the author.
+func sendMessageToQueries(session *discordgo.Session, m *discordgo.Message) {
+	if m.Author == nil {
+		return
+	}
+
+	var queryConns, knownConns []*ircConn
+	dmConns := false
+	for _, guildSession := range getGuildSessions(session.Token) {
+		for _, conn := range guildSession.conns {
+			if conn == nil {
+				continue
+			}
+			if guildSession.guildSessionType != guildSessionGuild {
+				dmConns = true
+			} else if conn.hasQuery(m.ChannelID) {
+				queryConns = append(queryConns, conn)
+			} else if m.Author.ID != guildSession.selfUser.ID && guildSession.userMap.GetName(m.Author.ID) != "" {
+				knownConns = append(knownConns, conn)
+			}
+		}
+	}
+
+	if len(queryConns) == 0 && !dmConns && len(knownConns) > 0 {
+		channel, err := session.State.Channel(m.ChannelID)
+		if err != nil {
+			channel, err = session.Channel(m.ChannelID)
+		}
+		if err != nil || channel.Type != discordgo.ChannelTypeDM {
+			return
+		}
+		for _, conn := range knownConns {
+			conn.addQuery(m.ChannelID, m.Author.ID)
+		}
+		queryConns = knownConns
+	}
+
+	date, err := m.Timestamp.Parse()
+	if err != nil {
+		return
+	}
+	for _, conn := range queryConns {
+		sendMessageFromDiscordToIRC(date, conn, m, "", "")
+	}
+}
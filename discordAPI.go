@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// discordgo doesn't know about some newer parts of the Discord API yet, so
+// the requests for those are built by hand here.
+
+// discordgo doesn't have these message types yet
+const (
+	messageTypeThreadCreated        discordgo.MessageType = 18
+	messageTypeReply                discordgo.MessageType = 19
+	messageTypeThreadStarterMessage discordgo.MessageType = 21
+)
+
+// custom statuses are sent as a "game" of this type, with the text in State
+const gameTypeCustomStatus discordgo.GameType = 4
+
+// permissionModerateMembers allows timing out members. It's past the 31 bits of permissions
+// that API v6 and discordgo have, so it's only in roles' permissions_new.
+const permissionModerateMembers int64 = 1 << 40
+
+const errCodeUnknownBan = 10026
+
+const (
+	channelTypeGuildNewsThread    discordgo.ChannelType = 10
+	channelTypeGuildPublicThread  discordgo.ChannelType = 11
+	channelTypeGuildPrivateThread discordgo.ChannelType = 12
+	channelTypeGuildStageVoice    discordgo.ChannelType = 13
+)
+
+// discordgo uses API v6, which doesn't have threads
+var endpointAPIv9 = discordgo.EndpointDiscord + "api/v9/"
+
+type messageReference struct {
+	MessageID string `json:"message_id"`
+	ChannelID string `json:"channel_id,omitempty"`
+	GuildID   string `json:"guild_id,omitempty"`
+}
+
+type messageSendReply struct {
+	Content          string            `json:"content"`
+	MessageReference *messageReference `json:"message_reference"`
+}
+
+func (g *guildSession) sendReply(channelID string, messageID string, content string) (message *discordgo.Message, err error) {
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	response, err := g.session.RequestWithBucketID("POST", endpoint, &messageSendReply{
+		Content: content,
+		MessageReference: &messageReference{
+			MessageID: messageID,
+			ChannelID: channelID,
+		},
+	}, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(response, &message)
+	return
+}
+
+// discordgo's ChannelFileSendWithMessage can't reply to a message
+func (g *guildSession) sendFile(channelID string, replyID string, name string, content io.Reader) (message *discordgo.Message, err error) {
+	payload := &messageSendReply{}
+	if replyID != "" {
+		payload.MessageReference = &messageReference{
+			MessageID: replyID,
+			ChannelID: channelID,
+		}
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err = writer.WriteField("payload_json", string(payloadJSON)); err != nil {
+		return nil, err
+	}
+	file, err := writer.CreateFormFile("file", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(file, content); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+
+	endpoint := discordgo.EndpointChannelMessages(channelID)
+	response, err := g.session.RequestWithLockedBucket("POST", endpoint, writer.FormDataContentType(), body.Bytes(), g.session.Ratelimiter.LockBucket(endpoint), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(response, &message)
+	return
+}
+
+// discordgo's ChannelEdit always sends the position and can't clear the topic
+func (g *guildSession) setChannelTopic(channelID string, topic string) (err error) {
+	_, err = g.session.RequestWithBucketID("PATCH", discordgo.EndpointChannel(channelID), struct {
+		Topic string `json:"topic"`
+	}{topic}, discordgo.EndpointChannel(channelID))
+	return
+}
+
+// setMemberTimeout times out a member until the given time, or removes their timeout if it's nil
+func (g *guildSession) setMemberTimeout(userID string, until *time.Time) (err error) {
+	var timestamp *string
+	if until != nil {
+		formatted := until.UTC().Format(time.RFC3339)
+		timestamp = &formatted
+	}
+	endpoint := discordgo.EndpointGuildMember(g.guild.ID, userID)
+	_, err = g.session.RequestWithBucketID("PATCH", endpoint, struct {
+		CommunicationDisabledUntil *string `json:"communication_disabled_until"`
+	}{timestamp}, discordgo.EndpointGuildMember(g.guild.ID, ""))
+	return
+}
+
+// getMemberPermissions returns a member's guild permissions from their roles' permissions_new,
+// which has the permissions discordgo's roles leave out
+func (g *guildSession) getMemberPermissions(member *discordgo.Member) (permissions int64, err error) {
+	endpoint := discordgo.EndpointGuildRoles(g.guild.ID)
+	response, err := g.session.RequestWithBucketID("GET", endpoint, nil, endpoint)
+	if err != nil {
+		return 0, err
+	}
+
+	var roles []struct {
+		ID             string `json:"id"`
+		PermissionsNew string `json:"permissions_new"`
+	}
+	if err = json.Unmarshal(response, &roles); err != nil {
+		return 0, err
+	}
+	hasRole := map[string]bool{g.guild.ID: true} // @everyone
+	for _, roleID := range member.Roles {
+		hasRole[roleID] = true
+	}
+	for _, role := range roles {
+		if !hasRole[role.ID] {
+			continue
+		}
+		rolePermissions, err := strconv.ParseInt(role.PermissionsNew, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		permissions |= rolePermissions
+	}
+	return
+}
+
+type threadMetadata struct {
+	Archived bool `json:"archived"`
+	Locked   bool `json:"locked"`
+}
+
+// thread is a thread channel, with the metadata discordgo doesn't know about
+type thread struct {
+	discordgo.Channel
+	ThreadMetadata *threadMetadata `json:"thread_metadata"`
+}
+
+func isThread(channel *discordgo.Channel) bool {
+	switch channel.Type {
+	case channelTypeGuildNewsThread, channelTypeGuildPublicThread, channelTypeGuildPrivateThread:
+		return true
+	}
+	return false
+}
+
+// getActiveThreads returns the guild's threads that aren't archived
+func (g *guildSession) getActiveThreads() (threads []*thread, err error) {
+	endpoint := endpointAPIv9 + "guilds/" + g.guild.ID + "/threads/active"
+	response, err := g.session.RequestWithBucketID("GET", endpoint, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var activeThreads struct {
+		Threads []*thread `json:"threads"`
+	}
+	err = json.Unmarshal(response, &activeThreads)
+	return activeThreads.Threads, err
+}
+
+// startThread creates a public thread from a message, or on its own if messageID is empty
+func (g *guildSession) startThread(channelID string, messageID string, name string) (newThread *thread, err error) {
+	data := struct {
+		Name                string                `json:"name"`
+		AutoArchiveDuration int                   `json:"auto_archive_duration"`
+		Type                discordgo.ChannelType `json:"type,omitempty"`
+	}{Name: name, AutoArchiveDuration: 1440}
+
+	endpoint := endpointAPIv9 + "channels/" + channelID + "/threads"
+	if messageID != "" {
+		endpoint = endpointAPIv9 + "channels/" + channelID + "/messages/" + messageID + "/threads"
+	} else {
+		data.Type = channelTypeGuildPublicThread
+	}
+	response, err := g.session.RequestWithBucketID("POST", endpoint, data, endpointAPIv9+"channels/"+channelID+"/threads")
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(response, &newThread)
+	return
+}
+
+// getMessagesAfter returns up to 100 of a channel's messages after a message, oldest first
+func (g *guildSession) getMessagesAfter(channelID string, after string) (messages []*discordgo.Message, err error) {
+	endpoint := endpointAPIv9 + "channels/" + channelID + "/messages"
+	response, err := g.session.RequestWithBucketID("GET", endpoint+"?limit=100&after="+after, nil, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(response, &messages)
+	sortMessages(messages)
+	return
+}
+
+type stickerItem struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// getStickers returns the stickers on a message, which discordgo doesn't parse.
+// They're cached, since every conn asks for them.
+func (g *guildSession) getStickers(channelID string, messageID string) (stickers []stickerItem, err error) {
+	g.stickersMutex.Lock()
+	stickers, exists := g.stickers[messageID]
+	g.stickersMutex.Unlock()
+	if exists {
+		return
+	}
+
+	endpoint := endpointAPIv9 + "channels/" + channelID + "/messages/" + messageID
+	response, err := g.session.RequestWithBucketID("GET", endpoint, nil, endpointAPIv9+"channels/"+channelID+"/messages/")
+	if err != nil {
+		return nil, err
+	}
+
+	var message struct {
+		StickerItems []stickerItem `json:"sticker_items"`
+		Stickers     []stickerItem `json:"stickers"` // before sticker_items
+	}
+	if err = json.Unmarshal(response, &message); err != nil {
+		return nil, err
+	}
+	stickers = message.StickerItems
+	if len(stickers) == 0 {
+		stickers = message.Stickers
+	}
+	g.stickersMutex.Lock()
+	g.stickers[messageID] = stickers
+	g.stickersMutex.Unlock()
+	return
+}
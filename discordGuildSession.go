@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,28 +20,48 @@ const (
 	guildSessionGuild
 )
 
+// topicSetter is who last changed a channel's topic, and when
+type topicSetter struct {
+	user *discordgo.User
+	date time.Time
+}
+
 type guildSession struct {
 	guildSessionType
-	guild         *discordgo.Guild
-	session       *discordgo.Session
-	selfMember    *discordgo.Member
-	selfUser      *discordgo.User
-	userMap       *snowflakemap.SnowflakeMap
-	channelMap    *snowflakemap.SnowflakeMap
-	roleMap       *snowflakemap.SnowflakeMap
-	channels      map[string]*discordgo.Channel // map[channelid]Channel
-	channelsMutex sync.RWMutex
-	members       map[string]*discordgo.Member
-	membersMutex  sync.RWMutex
-	membersDone   bool
-	roles         map[string]*discordgo.Role
-	rolesMutex    sync.RWMutex
-	messages      map[string]*discordgo.Message
-	messagesMutex sync.RWMutex
-	users         map[string]*discordgo.User
-	usersMutex    sync.RWMutex
-	conns         []*ircConn
-	connsMutex    sync.RWMutex
+	guild          *discordgo.Guild
+	session        *discordgo.Session
+	selfMember     *discordgo.Member
+	selfUser       *discordgo.User
+	userMap        *snowflakemap.SnowflakeMap
+	channelMap     *snowflakemap.SnowflakeMap
+	roleMap        *snowflakemap.SnowflakeMap
+	channels       map[string]*discordgo.Channel // map[channelid]Channel
+	channelsMutex  sync.RWMutex
+	members        map[string]*discordgo.Member
+	memberRoles    map[string][]string // map[userid]roles, copied because discordgo's State updates members in place
+	membersMutex   sync.RWMutex
+	membersDone    bool
+	membersWaiters []chan struct{} // signalled for each member chunk, closed when membersDone
+	waitersMutex   sync.Mutex
+	roles          map[string]*discordgo.Role
+	rolesMutex     sync.RWMutex
+	messages       map[string]*discordgo.Message
+	messagesMutex  sync.RWMutex
+	stickers       map[string][]stickerItem // map[messageid]stickers, which discordgo doesn't parse
+	stickersMutex  sync.Mutex
+	users          map[string]*discordgo.User
+	usersMutex     sync.RWMutex
+	presences      map[string]*discordgo.Presence // map[userid]Presence
+	presencesMutex sync.RWMutex
+	topicSetters   map[string]topicSetter // map[channelid]topicSetter
+	topicsLoaded   bool                   // whether topicSetters has been filled in from the audit log
+	topicsMutex    sync.RWMutex
+	topicsLoading  sync.Mutex        // held while loading topicSetters, so it's only done once
+	threadsSeen    map[string]string // map[threadid]messageid of the last message relayed from a thread
+	threadsMutex   sync.Mutex
+	conns          []*ircConn
+	connsMutex     sync.RWMutex
+	selfAlias      string // nick set with NICK in the DM session, guarded by usersMutex
 }
 
 func newDiscordSession(token string) (session *discordgo.Session, err error) {
@@ -141,16 +163,36 @@ func getGuildSession(token string, guildID string) (session *guildSession, err e
 	return
 }
 
+// getGuildSessions returns every guildSession for a token
+func getGuildSessions(token string) (sessions []*guildSession) {
+	guildsessionsMutex.Lock()
+	defer guildsessionsMutex.Unlock()
+	for _, session := range guildSessions[token] {
+		sessions = append(sessions, session)
+	}
+	return
+}
+
+// findGuildSession returns the existing guildSession for a token and guild, or connects a new one
+func findGuildSession(token string, guildID string) (session *guildSession, err error) {
+	session, err = getGuildSession(token, guildID)
+	if err == nil {
+		return
+	}
+	return newGuildSession(token, guildID)
+}
+
 // if guildID is empty, will return guildSession for DM server
 func newGuildSession(token string, guildID string) (session *guildSession, err error) {
 	discordSessionsMutex.Lock()
 	discordSession, exists := discordSessions[token]
 	if !exists {
 		discordSession, err = newDiscordSession(token)
-		discordSessions[token] = discordSession
 		if err != nil {
+			discordSessionsMutex.Unlock()
 			return nil, err
 		}
+		discordSessions[token] = discordSession
 	}
 	discordSessionsMutex.Unlock()
 
@@ -191,14 +233,21 @@ func newGuildSession(token string, guildID string) (session *guildSession, err e
 		channels:         make(map[string]*discordgo.Channel),
 		channelsMutex:    sync.RWMutex{},
 		members:          make(map[string]*discordgo.Member),
+		memberRoles:      make(map[string][]string),
 		membersMutex:     sync.RWMutex{},
 		membersDone:      false,
 		roles:            make(map[string]*discordgo.Role),
 		rolesMutex:       sync.RWMutex{},
 		messages:         make(map[string]*discordgo.Message),
 		messagesMutex:    sync.RWMutex{},
+		stickers:         make(map[string][]stickerItem),
 		users:            make(map[string]*discordgo.User),
 		usersMutex:       sync.RWMutex{},
+		presences:        make(map[string]*discordgo.Presence),
+		presencesMutex:   sync.RWMutex{},
+		topicSetters:     make(map[string]topicSetter),
+		threadsSeen:      make(map[string]string),
+		topicsMutex:      sync.RWMutex{},
 		conns:            []*ircConn{},
 		connsMutex:       sync.RWMutex{},
 	}
@@ -213,6 +262,10 @@ func newGuildSession(token string, guildID string) (session *guildSession, err e
 		if err != nil {
 			return nil, err
 		}
+		if err := session.populateThreads(); err != nil {
+			session.sendError("", "There was an error getting threads from Discord.", err)
+		}
+		session.populatePresences()
 	}
 
 	guildsessionsMutex.Lock()
@@ -242,6 +295,132 @@ func (g *guildSession) populateChannelMap() (err error) {
 	return
 }
 
+func (g *guildSession) populateThreads() (err error) {
+	threads, err := g.getActiveThreads()
+	if err != nil {
+		return err
+	}
+
+	for _, thread := range threads {
+		g.addChannel(&thread.Channel)
+	}
+
+	return
+}
+
+// threadPollInterval is how often threads are checked for changes and new messages.
+// discordgo connects to gateway v6, which doesn't send thread events or messages in threads.
+const threadPollInterval = 30 * time.Second
+
+func threadPollLoop() {
+	for range time.Tick(threadPollInterval) {
+		sessions := []*guildSession{}
+		guildsessionsMutex.Lock()
+		for _, sessionMap := range guildSessions {
+			for _, session := range sessionMap {
+				if session.guildSessionType == guildSessionGuild && len(session.conns) > 0 {
+					sessions = append(sessions, session)
+				}
+			}
+		}
+		guildsessionsMutex.Unlock()
+
+		for _, session := range sessions {
+			session.pollThreads()
+		}
+	}
+}
+
+// pollThreads adds new threads, parts everyone from archived ones and relays new messages in joined threads
+func (g *guildSession) pollThreads() {
+	threads, err := g.getActiveThreads()
+	if err != nil {
+		g.sendError("", "There was an error getting threads from Discord.", err)
+		return
+	}
+	active := make(map[string]bool)
+	for _, thread := range threads {
+		active[thread.ID] = true
+		if g.channelMap.GetName(thread.ID) == "" {
+			g.addChannel(&thread.Channel)
+		} else {
+			g.updateChannel(&thread.Channel)
+		}
+	}
+
+	g.threadsMutex.Lock()
+	seen := make(map[string]string, len(g.threadsSeen))
+	for threadID, messageID := range g.threadsSeen {
+		seen[threadID] = messageID
+	}
+	g.threadsMutex.Unlock()
+
+	for threadID, lastMessageID := range seen {
+		if !active[threadID] {
+			g.removeThread(threadID)
+			continue
+		}
+		if !g.isJoinedByAnyConn(threadID) {
+			continue
+		}
+
+		messages, err := g.getMessagesAfter(threadID, lastMessageID)
+		if err != nil {
+			g.sendError(threadID, "There was an error getting new messages in "+g.channelMap.GetName(threadID)+" from Discord.", err)
+			continue
+		}
+		for _, message := range messages {
+			message.GuildID = g.guild.ID
+			g.addMessage(message)
+			date, err := message.Timestamp.Parse()
+			if err != nil {
+				continue
+			}
+			for _, conn := range g.conns {
+				if conn != nil {
+					sendMessageFromDiscordToIRC(date, conn, message, "", "")
+				}
+			}
+		}
+		if len(messages) > 0 {
+			g.threadsMutex.Lock()
+			g.threadsSeen[threadID] = messages[len(messages)-1].ID
+			g.threadsMutex.Unlock()
+		}
+	}
+}
+
+func (g *guildSession) isJoinedByAnyConn(channelID string) bool {
+	for _, conn := range g.conns {
+		if conn != nil && conn.isJoined(channelID) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeThread parts everyone from an archived or deleted thread and forgets it
+func (g *guildSession) removeThread(threadID string) {
+	g.threadsMutex.Lock()
+	delete(g.threadsSeen, threadID)
+	g.threadsMutex.Unlock()
+
+	channelName := g.channelMap.GetName(threadID)
+	if channelName == "" {
+		return
+	}
+	for _, conn := range g.conns {
+		if conn == nil || !conn.isJoined(threadID) {
+			continue
+		}
+		conn.channelsMutex.Lock()
+		conn.channels[threadID] = false
+		conn.channelsMutex.Unlock()
+		conn.sendPART("", "", "", channelName, "Thread archived")
+	}
+	g.channelMap.RemoveSnowflake(threadID)
+}
+
 func (g *guildSession) populateUserMap(after string) (err error) {
 	members, err := g.session.GuildMembers(g.guild.ID, after, 1000)
 	if err != nil {
@@ -269,6 +448,16 @@ func (g *guildSession) populateRoleMap() (err error) {
 	return
 }
 
+func (g *guildSession) populatePresences() {
+	cachedGuild, err := g.session.State.Guild(g.guild.ID)
+	if err != nil {
+		return
+	}
+	for _, presence := range cachedGuild.Presences {
+		g.updatePresence(presence)
+	}
+}
+
 func (g *guildSession) getChannel(channelID string) (channel *discordgo.Channel, err error) {
 	g.channelsMutex.Lock()
 	defer g.channelsMutex.Unlock()
@@ -287,14 +476,27 @@ func (g *guildSession) getChannel(channelID string) (channel *discordgo.Channel,
 }
 
 func (g *guildSession) addChannel(channel *discordgo.Channel) (name string) {
-	g.channelsMutex.Lock()
-	g.channels[channel.ID] = channel
-	g.channelsMutex.Unlock()
-	if channel.Type != discordgo.ChannelTypeGuildText && channel.Type != discordgo.ChannelTypeGuildNews && channel.Type != discordgo.ChannelTypeDM && channel.Type != discordgo.ChannelTypeGroupDM {
+	g.updateChannel(channel)
+	if channel.Type != discordgo.ChannelTypeGuildText && channel.Type != discordgo.ChannelTypeGuildNews && channel.Type != discordgo.ChannelTypeDM && channel.Type != discordgo.ChannelTypeGroupDM && !isThread(channel) {
 		return ""
 	}
 
-	if channel.Name == "" && channel.Recipients != nil && len(channel.Recipients) > 0 { // DM channel
+	if isThread(channel) { // #parent/thread
+		g.threadsMutex.Lock()
+		if _, exists := g.threadsSeen[channel.ID]; !exists {
+			// a thread's ID is the ID of the message it was started from, so this skips that too
+			g.threadsSeen[channel.ID] = channel.ID
+			if channel.LastMessageID != "" {
+				g.threadsSeen[channel.ID] = channel.LastMessageID
+			}
+		}
+		g.threadsMutex.Unlock()
+		parentName := g.channelMap.GetName(channel.ParentID)
+		if parentName == "" {
+			return ""
+		}
+		name = parentName + "/" + strings.TrimPrefix(convertDiscordChannelNameToIRC(channel.Name), "#")
+	} else if channel.Name == "" && channel.Recipients != nil && len(channel.Recipients) > 0 { // DM channel
 		if len(channel.Recipients) == 1 {
 			name = g.getNick(channel.Recipients[0])
 		} else {
@@ -310,9 +512,108 @@ func (g *guildSession) addChannel(channel *discordgo.Channel) (name string) {
 	return g.channelMap.Add(name, channel.ID)
 }
 
+// getSortedChannels returns every channel in the order Discord shows them:
+// uncategorized channels, then each category followed by its text and then voice channels.
+// Threads follow their parent.
+func (g *guildSession) getSortedChannels() (sorted []*discordgo.Channel) {
+	var channels []*discordgo.Channel
+	threads := make(map[string][]*discordgo.Channel) // map[parentid][]Channel
+	g.channelsMutex.RLock()
+	for _, channel := range g.channels {
+		if isThread(channel) {
+			threads[channel.ParentID] = append(threads[channel.ParentID], channel)
+		} else {
+			channels = append(channels, channel)
+		}
+	}
+	g.channelsMutex.RUnlock()
+
+	categoryPositions := make(map[string]int) // map[channelid]position of its category
+	for _, channel := range channels {
+		if channel.Type == discordgo.ChannelTypeGuildCategory {
+			categoryPositions[channel.ID] = channel.Position
+		}
+	}
+	categoryPosition := func(channel *discordgo.Channel) int {
+		if channel.Type == discordgo.ChannelTypeGuildCategory {
+			return channel.Position
+		}
+		if position, exists := categoryPositions[channel.ParentID]; exists {
+			return position
+		}
+		return -1
+	}
+	rank := func(channel *discordgo.Channel) int {
+		switch channel.Type {
+		case discordgo.ChannelTypeGuildCategory:
+			return 0
+		case discordgo.ChannelTypeGuildVoice, channelTypeGuildStageVoice:
+			return 2
+		}
+		return 1
+	}
+	sort.SliceStable(channels, func(i, j int) bool {
+		a, b := channels[i], channels[j]
+		if categoryPosition(a) != categoryPosition(b) {
+			return categoryPosition(a) < categoryPosition(b)
+		}
+		if rank(a) != rank(b) {
+			return rank(a) < rank(b)
+		}
+		if a.Position != b.Position {
+			return a.Position < b.Position
+		}
+		return snowflakeLess(a.ID, b.ID)
+	})
+
+	for _, channel := range channels {
+		sorted = append(sorted, channel)
+		children := threads[channel.ID]
+		sort.Slice(children, func(i, j int) bool {
+			return snowflakeLess(children[i].ID, children[j].ID)
+		})
+		sorted = append(sorted, children...)
+	}
+	return
+}
+
+// getChannelMarkers describes a channel's category and type for the topic in LIST
+func (g *guildSession) getChannelMarkers(channel *discordgo.Channel) string {
+	var markers []string
+	if channel.Type == channelTypeGuildPrivateThread {
+		markers = append(markers, "[private thread]")
+	} else if isThread(channel) {
+		markers = append(markers, "[thread]")
+	} else if channel.ParentID != "" {
+		if parent, err := g.getChannel(channel.ParentID); err == nil {
+			markers = append(markers, "["+parent.Name+"]")
+		}
+	}
+	switch channel.Type {
+	case discordgo.ChannelTypeGuildCategory:
+		markers = append(markers, "[category]")
+	case discordgo.ChannelTypeGuildVoice:
+		markers = append(markers, "[voice]")
+	case channelTypeGuildStageVoice:
+		markers = append(markers, "[stage]")
+	case discordgo.ChannelTypeGuildNews:
+		markers = append(markers, "[news]")
+	}
+	if channel.NSFW {
+		markers = append(markers, "[nsfw]")
+	}
+	if len(markers) == 0 {
+		return ""
+	}
+	return strings.Join(markers, " ") + " "
+}
+
+// updateChannel stores a copy of a channel. discordgo's State updates its channels in place,
+// so keeping its pointer would lose the old channel that updates are compared against.
 func (g *guildSession) updateChannel(channel *discordgo.Channel) {
+	copied := *channel
 	g.channelsMutex.Lock()
-	g.channels[channel.ID] = channel
+	g.channels[channel.ID] = &copied
 	g.channelsMutex.Unlock()
 }
 
@@ -334,31 +635,47 @@ func (g *guildSession) updateRole(role *discordgo.Role) {
 }
 
 func (g *guildSession) removeRole(roleID string) {
+	g.rolesMutex.Lock()
+	delete(g.roles, roleID)
+	g.rolesMutex.Unlock()
 	g.roleMap.RemoveSnowflake(roleID)
 }
 
 func (g *guildSession) addMember(member *discordgo.Member) (name string) {
 	g.membersMutex.Lock()
 	g.members[member.User.ID] = member
+	g.memberRoles[member.User.ID] = append([]string(nil), member.Roles...)
 	g.membersMutex.Unlock()
 	return g.addUser(member.User)
 }
 
-func (g *guildSession) updateMember(member *discordgo.Member) {
+// updateMember stores a member and returns the roles they had before, if we knew them
+func (g *guildSession) updateMember(member *discordgo.Member) (oldRoles []string, known bool) {
 	g.membersMutex.Lock()
+	oldRoles, known = g.memberRoles[member.User.ID]
 	g.members[member.User.ID] = member
+	g.memberRoles[member.User.ID] = append([]string(nil), member.Roles...)
 	g.membersMutex.Unlock()
 	g.updateUser(member.User)
+	return
 }
 
 func (g *guildSession) removeMember(member *discordgo.Member) {
+	g.membersMutex.Lock()
+	delete(g.members, member.User.ID)
+	delete(g.memberRoles, member.User.ID)
+	g.membersMutex.Unlock()
 	g.removeUser(member.User)
 }
 
 func (g *guildSession) addUser(user *discordgo.User) (name string) {
 	g.usersMutex.Lock()
 	g.users[user.ID] = user
+	selfAlias := g.selfAlias
 	g.usersMutex.Unlock()
+	if selfAlias != "" && g.selfUser != nil && user.ID == g.selfUser.ID {
+		return g.userMap.Add(selfAlias, user.ID)
+	}
 	member, err := g.getMember(user.ID)
 	if note, ok := g.session.State.Notes[user.ID]; ok {
 		kv := strings.Split(strings.Split(note, "\n")[0], ": ")
@@ -375,7 +692,12 @@ func (g *guildSession) addUser(user *discordgo.User) (name string) {
 func (g *guildSession) updateUser(user *discordgo.User) {
 	g.usersMutex.Lock()
 	g.users[user.ID] = user
+	selfAlias := g.selfAlias
 	g.usersMutex.Unlock()
+	if selfAlias != "" && g.selfUser != nil && user.ID == g.selfUser.ID {
+		g.userMap.Add(selfAlias, user.ID)
+		return
+	}
 	member, err := g.getMember(user.ID)
 	if note, ok := g.session.State.Notes[user.ID]; ok {
 		kv := strings.Split(strings.Split(note, "\n")[0], ": ")
@@ -395,6 +717,24 @@ func (g *guildSession) removeUser(user *discordgo.User) {
 	g.userMap.RemoveSnowflake(user.ID)
 }
 
+// updatePresence stores a user's presence and returns the one it replaced
+func (g *guildSession) updatePresence(presence *discordgo.Presence) (oldPresence *discordgo.Presence) {
+	if presence.User == nil {
+		return nil
+	}
+	g.presencesMutex.Lock()
+	defer g.presencesMutex.Unlock()
+	oldPresence = g.presences[presence.User.ID]
+	g.presences[presence.User.ID] = presence
+	return
+}
+
+func (g *guildSession) getPresence(userID string) *discordgo.Presence {
+	g.presencesMutex.RLock()
+	defer g.presencesMutex.RUnlock()
+	return g.presences[userID]
+}
+
 func (g *guildSession) addMessage(message *discordgo.Message) {
 	g.messagesMutex.Lock()
 	g.messages[message.ID] = message
@@ -413,7 +753,7 @@ func (g *guildSession) getMessage(channelID string, messageID string) (message *
 		return
 	}
 
-	message, err = g.session.ChannelMessage(g.guild.ID, messageID)
+	message, err = g.session.ChannelMessage(channelID, messageID)
 	if err != nil {
 		return nil, err
 	}
@@ -422,6 +762,77 @@ func (g *guildSession) getMessage(channelID string, messageID string) (message *
 	return
 }
 
+// getHistoryBefore pages backwards through a channel's history, starting before the
+// message before (or the latest message if empty) and stopping at the message bound.
+// Messages are returned oldest first.
+func (g *guildSession) getHistoryBefore(channelID string, before string, bound string, limit int) (messages []*discordgo.Message, err error) {
+	for len(messages) < limit {
+		var page []*discordgo.Message
+		page, err = g.session.ChannelMessages(channelID, minInt(limit-len(messages), 100), before, "", "")
+		if err != nil {
+			return nil, err
+		}
+		sortMessages(page)
+		for i := len(page) - 1; i >= 0; i-- {
+			if bound != "" && !snowflakeLess(bound, page[i].ID) {
+				page = page[i+1:]
+				break
+			}
+		}
+		for _, message := range page {
+			g.addMessage(message)
+		}
+		messages = append(page, messages...)
+		if len(page) < 100 {
+			break
+		}
+		before = page[0].ID
+	}
+	return
+}
+
+// getHistoryAfter pages forwards through a channel's history, starting after the message
+// after and stopping at the message bound (or the latest message if empty).
+// Messages are returned oldest first.
+func (g *guildSession) getHistoryAfter(channelID string, after string, bound string, limit int) (messages []*discordgo.Message, err error) {
+	for len(messages) < limit {
+		var page []*discordgo.Message
+		page, err = g.session.ChannelMessages(channelID, minInt(limit-len(messages), 100), "", after, "")
+		if err != nil {
+			return nil, err
+		}
+		sortMessages(page)
+		for i, message := range page {
+			if bound != "" && !snowflakeLess(message.ID, bound) {
+				page = page[:i]
+				break
+			}
+		}
+		for _, message := range page {
+			g.addMessage(message)
+		}
+		messages = append(messages, page...)
+		if len(page) < 100 {
+			break
+		}
+		after = page[len(page)-1].ID
+	}
+	return
+}
+
+// getHistoryAround returns up to 100 messages centered on the message around, oldest first
+func (g *guildSession) getHistoryAround(channelID string, around string, limit int) (messages []*discordgo.Message, err error) {
+	messages, err = g.session.ChannelMessages(channelID, minInt(limit, 100), "", "", around)
+	if err != nil {
+		return nil, err
+	}
+	sortMessages(messages)
+	for _, message := range messages {
+		g.addMessage(message)
+	}
+	return
+}
+
 func (g *guildSession) getUser(userID string) (user *discordgo.User, err error) {
 	member, err := g.getMember(userID)
 	if err != nil {
@@ -430,6 +841,455 @@ func (g *guildSession) getUser(userID string) (user *discordgo.User, err error)
 	return member.User, nil
 }
 
+// getKnownUser returns a user we've already seen, without asking Discord
+func (g *guildSession) getKnownUser(userID string) *discordgo.User {
+	g.usersMutex.RLock()
+	defer g.usersMutex.RUnlock()
+	return g.users[userID]
+}
+
+// getChannelUsers returns the users in a channel
+func (g *guildSession) getChannelUsers(channelID string) (users []*discordgo.User) {
+	if g.guildSessionType == guildSessionDM {
+		channel, err := g.getChannel(channelID)
+		if err != nil {
+			return nil
+		}
+		users = append(users, channel.Recipients...)
+		return append(users, g.selfUser)
+	}
+
+	channel, err := g.getChannel(channelID)
+	if err != nil {
+		return nil
+	}
+	for _, member := range g.getMembers() {
+		if g.canView(member, channel) {
+			users = append(users, member.User)
+		}
+	}
+	return
+}
+
+// getChannelUserCounts returns how many users can see each of the channels. Members with the same roles
+// can see the same channels unless they have an overwrite of their own, so they're only checked once.
+func (g *guildSession) getChannelUserCounts(channels []*discordgo.Channel) map[string]int {
+	counts := make(map[string]int) // map[channelid]users
+	if g.guildSessionType == guildSessionDM {
+		for _, channel := range channels {
+			counts[channel.ID] = len(g.getChannelUsers(channel.ID))
+		}
+		return counts
+	}
+
+	groups := make(map[string][]*discordgo.Member) // map[sorted role ids]members with those roles
+	for _, member := range g.getMembers() {
+		roles := append([]string(nil), member.Roles...)
+		sort.Strings(roles)
+		key := strings.Join(roles, ",")
+		groups[key] = append(groups[key], member)
+	}
+
+	for _, channel := range channels {
+		overwrites := channel
+		if isThread(channel) {
+			if parent, err := g.getChannel(channel.ParentID); err == nil {
+				overwrites = parent
+			}
+		}
+		ownOverwrite := make(map[string]bool)
+		for _, overwrite := range overwrites.PermissionOverwrites {
+			if overwrite.Type == "member" {
+				ownOverwrite[overwrite.ID] = true
+			}
+		}
+
+		for _, members := range groups {
+			shared := -1 // 1 if the members without their own overwrite can see it, 0 if not, -1 if not checked yet
+			for _, member := range members {
+				if member.User == nil {
+					continue
+				}
+				if ownOverwrite[member.User.ID] || member.User.ID == g.guild.OwnerID {
+					if g.canView(member, channel) {
+						counts[channel.ID]++
+					}
+					continue
+				}
+				if shared < 0 {
+					shared = 0
+					if g.canView(member, channel) {
+						shared = 1
+					}
+				}
+				counts[channel.ID] += shared
+			}
+		}
+	}
+	return counts
+}
+
+// getMembers returns every member we know of
+func (g *guildSession) getMembers() (members []*discordgo.Member) {
+	g.membersMutex.RLock()
+	defer g.membersMutex.RUnlock()
+	for _, member := range g.members {
+		members = append(members, member)
+	}
+	return
+}
+
+// waitForMembers returns a channel that's signalled whenever a member chunk arrives and closed once
+// we have every member. It returns nil if we already do.
+func (g *guildSession) waitForMembers() chan struct{} {
+	g.waitersMutex.Lock()
+	defer g.waitersMutex.Unlock()
+	if g.membersDone {
+		return nil
+	}
+	waiter := make(chan struct{}, 1)
+	g.membersWaiters = append(g.membersWaiters, waiter)
+	return waiter
+}
+
+func (g *guildSession) stopWaitingForMembers(waiter chan struct{}) {
+	g.waitersMutex.Lock()
+	defer g.waitersMutex.Unlock()
+	for i, w := range g.membersWaiters {
+		if w == waiter {
+			g.membersWaiters = append(g.membersWaiters[:i], g.membersWaiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// membersChunkReceived wakes up everyone waiting for members
+func (g *guildSession) membersChunkReceived(done bool) {
+	g.waitersMutex.Lock()
+	defer g.waitersMutex.Unlock()
+	for _, waiter := range g.membersWaiters {
+		if done {
+			close(waiter)
+			continue
+		}
+		select {
+		case waiter <- struct{}{}:
+		default: // it hasn't handled the last chunk yet
+		}
+	}
+	if done {
+		g.membersDone = true
+		g.membersWaiters = nil
+	}
+}
+
+// canView reports whether a member can see a channel. Threads have the permissions of their parent.
+func (g *guildSession) canView(member *discordgo.Member, channel *discordgo.Channel) bool {
+	if isThread(channel) {
+		parent, err := g.getChannel(channel.ParentID)
+		if err != nil {
+			return false
+		}
+		channel = parent
+	}
+	return g.getPermissions(member, channel)&discordgo.PermissionReadMessages != 0
+}
+
+// getJoinedChannels returns the channels joined by any of our conns
+func (g *guildSession) getJoinedChannels() (channels []*discordgo.Channel) {
+	channelIDs := make(map[string]bool)
+	for _, conn := range g.conns {
+		if conn == nil {
+			continue
+		}
+		conn.channelsMutex.RLock()
+		for channelID, joined := range conn.channels {
+			if joined {
+				channelIDs[channelID] = true
+			}
+		}
+		conn.channelsMutex.RUnlock()
+	}
+	for channelID := range channelIDs {
+		if channel, err := g.getChannel(channelID); err == nil {
+			channels = append(channels, channel)
+		}
+	}
+	return
+}
+
+// getViewers returns who can view each channel, as map[channelid]map[userid]User
+func (g *guildSession) getViewers(channels []*discordgo.Channel) map[string]map[string]*discordgo.User {
+	members := g.getMembers()
+	viewers := make(map[string]map[string]*discordgo.User)
+	for _, channel := range channels {
+		viewers[channel.ID] = make(map[string]*discordgo.User)
+		for _, member := range members {
+			if g.canView(member, channel) {
+				viewers[channel.ID][member.User.ID] = member.User
+			}
+		}
+	}
+	return viewers
+}
+
+// sendViewerChanges sends JOIN and PART for everyone who gained or lost access to a channel
+// between two calls to getViewers
+func (g *guildSession) sendViewerChanges(before map[string]map[string]*discordgo.User, after map[string]map[string]*discordgo.User) {
+	for channelID, newViewers := range after {
+		channel, err := g.getChannel(channelID)
+		if err != nil {
+			continue
+		}
+		oldViewers := before[channelID]
+		for _, conn := range g.conns {
+			if conn == nil {
+				continue
+			}
+			for userID, user := range newViewers {
+				if oldViewers[userID] == nil {
+					sendVisibilityChangeFromDiscordToIRC(conn, channel, user, true)
+				}
+			}
+			for userID, user := range oldViewers {
+				if newViewers[userID] == nil {
+					sendVisibilityChangeFromDiscordToIRC(conn, channel, user, false)
+				}
+			}
+		}
+	}
+}
+
+// getPermissions computes what a member is allowed to do in a channel, or in the guild if channel is nil
+func (g *guildSession) getPermissions(member *discordgo.Member, channel *discordgo.Channel) (permissions int) {
+	if g.guild == nil || member == nil || member.User == nil {
+		return 0
+	}
+	if member.User.ID == g.guild.OwnerID {
+		return discordgo.PermissionAll
+	}
+
+	g.rolesMutex.RLock()
+	if everyone, exists := g.roles[g.guild.ID]; exists {
+		permissions = everyone.Permissions
+	}
+	for _, roleID := range member.Roles {
+		if role, exists := g.roles[roleID]; exists {
+			permissions |= role.Permissions
+		}
+	}
+	g.rolesMutex.RUnlock()
+
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return discordgo.PermissionAll
+	}
+	if channel == nil {
+		return
+	}
+
+	// @everyone overwrites first, then roles, then the member itself
+	var allow, deny int
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == "role" && overwrite.ID == g.guild.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+		}
+	}
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type != "role" || overwrite.ID == g.guild.ID {
+			continue
+		}
+		for _, roleID := range member.Roles {
+			if overwrite.ID == roleID {
+				deny |= overwrite.Deny
+				allow |= overwrite.Allow
+			}
+		}
+	}
+	permissions &^= deny
+	permissions |= allow
+	for _, overwrite := range channel.PermissionOverwrites {
+		if overwrite.Type == "member" && overwrite.ID == member.User.ID {
+			permissions &^= overwrite.Deny
+			permissions |= overwrite.Allow
+		}
+	}
+	return
+}
+
+// getMemberModes returns the IRC membership modes a member gets in a channel from their roles
+func (g *guildSession) getMemberModes(member *discordgo.Member, channel *discordgo.Channel) (modes string) {
+	if g.guildSessionType != guildSessionGuild || member == nil {
+		return ""
+	}
+	permissions := g.getPermissions(member, channel)
+	if permissions&(discordgo.PermissionManageMessages|discordgo.PermissionAdministrator) != 0 {
+		modes += "o"
+	}
+	if permissions&discordgo.PermissionKickMembers != 0 {
+		modes += "h"
+	}
+	g.rolesMutex.RLock()
+	defer g.rolesMutex.RUnlock()
+	for _, roleID := range member.Roles {
+		if role, exists := g.roles[roleID]; exists && role.Hoist {
+			modes += "v"
+			break
+		}
+	}
+	return
+}
+
+// getUserModes is getMemberModes for a cached member
+func (g *guildSession) getUserModes(channel *discordgo.Channel, userID string) string {
+	g.membersMutex.RLock()
+	member := g.members[userID]
+	g.membersMutex.RUnlock()
+	return g.getMemberModes(member, channel)
+}
+
+// topicSetterRetries is how many more times the audit log is checked, a second apart,
+// for a topic change that Discord hasn't added to it yet
+const topicSetterRetries = 3
+
+// topicChange is a change of a channel's topic in the audit log
+type topicChange struct {
+	channelID string
+	topic     string
+	userID    string
+	date      time.Time
+}
+
+func (g *guildSession) canViewAuditLog() bool {
+	return g.guildSessionType == guildSessionGuild && g.getPermissions(g.selfMember, nil)&discordgo.PermissionViewAuditLogs != 0
+}
+
+// getTopicChanges returns the latest topic changes of every channel in the audit log, newest first
+func (g *guildSession) getTopicChanges() (changes []topicChange, err error) {
+	auditLog, err := g.session.GuildAuditLog(g.guild.ID, "", "", discordgo.AuditLogActionChannelUpdate, 100)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range auditLog.AuditLogEntries {
+		for _, change := range entry.Changes {
+			if change.Key != "topic" {
+				continue
+			}
+			topic, _ := change.NewValue.(string) // nil if it was cleared
+			changes = append(changes, topicChange{
+				channelID: entry.TargetID,
+				topic:     topic,
+				userID:    entry.UserID,
+				date:      getTimeFromSnowflake(entry.ID),
+			})
+		}
+	}
+	return
+}
+
+func (g *guildSession) getTopicChangeSetter(change topicChange) (setter topicSetter) {
+	setter.date = change.date
+	if user := g.getKnownUser(change.userID); user != nil {
+		setter.user = user
+	} else if user, err := g.session.User(change.userID); err == nil {
+		setter.user = user
+	}
+	return
+}
+
+// findTopicSetter looks in the audit log for who changed a channel's topic to what it is now.
+// If they can't be found, the user is nil and the date is now.
+func (g *guildSession) findTopicSetter(channel *discordgo.Channel) (setter topicSetter) {
+	setter.date = time.Now()
+	if !g.canViewAuditLog() {
+		return
+	}
+
+	for attempt := 0; attempt <= topicSetterRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Second)
+		}
+		changes, err := g.getTopicChanges()
+		if err != nil {
+			g.sendError(channel.ID, "There was an error getting who set the topic of "+g.channelMap.GetName(channel.ID)+" from Discord.", err)
+			return
+		}
+		for _, change := range changes {
+			if change.channelID != channel.ID {
+				continue
+			}
+			if change.topic == channel.Topic {
+				return g.getTopicChangeSetter(change)
+			}
+			break // the latest change is an older one, so this one isn't in the audit log yet
+		}
+	}
+	return
+}
+
+// loadTopicSetters fills in topicSetters for every channel in the audit log with one request,
+// so joining many channels doesn't need a request each. Concurrent callers wait for the first.
+func (g *guildSession) loadTopicSetters() {
+	g.topicsLoading.Lock()
+	defer g.topicsLoading.Unlock()
+	g.topicsMutex.RLock()
+	loaded := g.topicsLoaded
+	g.topicsMutex.RUnlock()
+	if loaded {
+		return
+	}
+
+	setters := make(map[string]topicSetter) // map[channelid]topicSetter
+	if g.canViewAuditLog() {
+		changes, err := g.getTopicChanges()
+		if err != nil {
+			g.sendError("", "There was an error getting who set channel topics from Discord.", err)
+			return
+		}
+		for _, change := range changes { // newest first
+			if _, exists := setters[change.channelID]; !exists {
+				setters[change.channelID] = g.getTopicChangeSetter(change)
+			}
+		}
+	}
+
+	g.topicsMutex.Lock()
+	for channelID, setter := range setters {
+		if _, exists := g.topicSetters[channelID]; !exists { // a newer change from a channel update
+			g.topicSetters[channelID] = setter
+		}
+	}
+	g.topicsLoaded = true
+	g.topicsMutex.Unlock()
+}
+
+// getTopicSetter returns the nick that last set a channel's topic and when
+func (g *guildSession) getTopicSetter(channel *discordgo.Channel) (nick string, date time.Time) {
+	g.topicsMutex.RLock()
+	loaded := g.topicsLoaded
+	g.topicsMutex.RUnlock()
+	if !loaded {
+		g.loadTopicSetters()
+	}
+
+	g.topicsMutex.RLock()
+	setter, exists := g.topicSetters[channel.ID]
+	g.topicsMutex.RUnlock()
+	if !exists { // it hasn't changed recently, or we can't see the audit log
+		setter.date = getTimeFromSnowflake(channel.ID)
+	}
+	if setter.user == nil {
+		return serverhostname, setter.date
+	}
+	return g.getNick(setter.user), setter.date
+}
+
+func (g *guildSession) setTopicSetter(channelID string, setter topicSetter) {
+	g.topicsMutex.Lock()
+	g.topicSetters[channelID] = setter
+	g.topicsMutex.Unlock()
+}
+
 func (g *guildSession) getRole(roleID string) (role *discordgo.Role, err error) {
 	g.rolesMutex.Lock()
 	role, exists := g.roles[roleID]
@@ -481,6 +1341,7 @@ func (g *guildSession) getMember(userID string) (member *discordgo.Member, err e
 	}
 
 	g.members[userID] = member
+	g.memberRoles[userID] = append([]string(nil), member.Roles...)
 	return
 }
 
@@ -520,6 +1381,24 @@ func (g *guildSession) addConn(conn *ircConn) {
 	g.connsMutex.Unlock()
 }
 
+// sendError logs an error from work that no IRC command is waiting on, and sends a NOTICE to
+// the conns that have joined the channel it's about, or to every conn if channelID is empty
+func (g *guildSession) sendError(channelID string, message string, err error) {
+	guildID := ""
+	if g.guild != nil {
+		guildID = g.guild.ID
+	}
+	fmt.Printf("guild %q channel %q: %s: %v\n", guildID, channelID, message, err)
+
+	g.connsMutex.RLock()
+	defer g.connsMutex.RUnlock()
+	for _, conn := range g.conns {
+		if channelID == "" || conn.isJoined(channelID) {
+			conn.sendNOTICE(message)
+		}
+	}
+}
+
 func (g *guildSession) removeConn(conn *ircConn) {
 	g.connsMutex.Lock()
 	for i, _conn := range g.conns {
@@ -14,6 +14,8 @@ func addHandlers(s *discordgo.Session) {
 	s.AddHandler(messageCreate)
 	s.AddHandler(messageDelete)
 	s.AddHandler(messageUpdate)
+	s.AddHandler(messageReactionAdd)
+	s.AddHandler(messageReactionRemove)
 	s.AddHandler(channelCreate)
 	s.AddHandler(channelDelete)
 	s.AddHandler(channelUpdate)
@@ -23,6 +25,7 @@ func addHandlers(s *discordgo.Session) {
 	s.AddHandler(guildMemberAdd)
 	s.AddHandler(guildMemberRemove)
 	s.AddHandler(guildMemberUpdate)
+	s.AddHandler(presenceUpdate)
 }
 
 func guildMembersChunk(session *discordgo.Session, chunk *discordgo.GuildMembersChunk) {
@@ -41,9 +44,7 @@ func guildMembersChunk(session *discordgo.Session, chunk *discordgo.GuildMembers
 		guildSession.addMember(member)
 	}
 	fmt.Printf("we have %d members of %d\n", len(cachedGuild.Members), guildSession.guild.MemberCount)
-	if len(cachedGuild.Members) >= guildSession.guild.MemberCount {
-		guildSession.membersDone = true
-	}
+	guildSession.membersChunkReceived(len(cachedGuild.Members) >= guildSession.guild.MemberCount)
 }
 
 func removeDuplicateMembers(list *[]*discordgo.Member) {
@@ -60,6 +61,10 @@ func removeDuplicateMembers(list *[]*discordgo.Member) {
 }
 
 func messageCreate(session *discordgo.Session, message *discordgo.MessageCreate) {
+	if message.GuildID == "" {
+		sendMessageToQueries(session, message.Message)
+	}
+
 	var guildSession *guildSession
 	var err error
 	if message.GuildID != "" {
@@ -118,17 +123,48 @@ func messageDelete(session *discordgo.Session, message *discordgo.MessageDelete)
 		return
 	}
 	for _, conn := range guildSession.conns {
-
 		if conn == nil {
 			continue
 		}
+		if conn.user.supportedCapabilities["draft/message-redaction"] {
+			ircChannel := guildSession.channelMap.GetName(message.ChannelID)
+			if ircChannel != "" && conn.isJoined(message.ChannelID) {
+				conn.sendREDACT(ircChannel, message.ID)
+			}
+			continue
+		}
 		oldMessage, err := guildSession.getMessage(message.ChannelID, message.ID)
 		if err != nil {
-			return
+			continue
 		}
 		sendMessageFromDiscordToIRC(time.Now(), conn, oldMessage, "\x0304message sent \x0f\x02"+humanize.Time(getTimeFromSnowflake(message.ID))+"\x0f \x0304in this channel was deleted:\n", "")
+	}
+}
+
+func messageReactionAdd(session *discordgo.Session, reaction *discordgo.MessageReactionAdd) {
+	guildSession, err := getGuildSession(session.Token, reaction.GuildID)
+	if err != nil {
+		return
+	}
+	for _, conn := range guildSession.conns {
+		if conn == nil {
+			continue
+		}
+		sendReactionFromDiscordToIRC(conn, reaction.MessageReaction, false)
+	}
+}
+
+func messageReactionRemove(session *discordgo.Session, reaction *discordgo.MessageReactionRemove) {
+	guildSession, err := getGuildSession(session.Token, reaction.GuildID)
+	if err != nil {
 		return
 	}
+	for _, conn := range guildSession.conns {
+		if conn == nil {
+			continue
+		}
+		sendReactionFromDiscordToIRC(conn, reaction.MessageReaction, true)
+	}
 }
 
 func channelCreate(session *discordgo.Session, channel *discordgo.ChannelCreate) {
@@ -154,7 +190,49 @@ func channelUpdate(session *discordgo.Session, channel *discordgo.ChannelUpdate)
 	if err != nil {
 		return
 	}
+	oldChannel, err := guildSession.getChannel(channel.ID)
+	oldTopic := ""
+	var oldViewers map[string]map[string]*discordgo.User
+	if err == nil {
+		oldTopic = oldChannel.Topic
+		oldViewers = guildSession.getViewers([]*discordgo.Channel{oldChannel})
+	}
 	guildSession.updateChannel(channel.Channel)
+	if oldViewers != nil {
+		guildSession.sendViewerChanges(oldViewers, guildSession.getViewers([]*discordgo.Channel{channel.Channel}))
+	}
+	if err != nil || oldTopic == channel.Topic {
+		return
+	}
+
+	// Discord can add the change to the audit log a little after the update, so wait for it elsewhere
+	go sendTopicChange(guildSession, channel.Channel)
+}
+
+// sendTopicChange sends a channel's new topic once we know who set it
+func sendTopicChange(guildSession *guildSession, channel *discordgo.Channel) {
+	setter := guildSession.findTopicSetter(channel)
+	if current, err := guildSession.getChannel(channel.ID); err == nil && current.Topic != channel.Topic {
+		return // it's been changed again, and that change is sent instead
+	}
+	guildSession.setTopicSetter(channel.ID, setter)
+
+	ircChannel := guildSession.getChannelName(channel)
+	if ircChannel == "" {
+		return
+	}
+	for _, conn := range guildSession.conns {
+		if conn == nil || !conn.isJoined(channel.ID) {
+			continue
+		}
+		topic := convertDiscordTopicToIRC(channel.Topic, conn)
+		if setter.user == nil {
+			conn.sendTOPIC("", "", "", ircChannel, topic)
+			continue
+		}
+		nick := guildSession.getNick(setter.user)
+		conn.sendTOPIC(nick, nick, setter.user.ID, ircChannel, topic)
+	}
 }
 
 func guildRoleCreate(session *discordgo.Session, role *discordgo.GuildRoleCreate) {
@@ -170,7 +248,9 @@ func guildRoleDelete(session *discordgo.Session, role *discordgo.GuildRoleDelete
 	if err != nil {
 		return
 	}
+	oldViewers := guildSession.getViewers(guildSession.getJoinedChannels())
 	guildSession.removeRole(role.RoleID)
+	guildSession.sendViewerChanges(oldViewers, guildSession.getViewers(guildSession.getJoinedChannels()))
 }
 
 func guildRoleUpdate(session *discordgo.Session, role *discordgo.GuildRoleUpdate) {
@@ -179,7 +259,9 @@ func guildRoleUpdate(session *discordgo.Session, role *discordgo.GuildRoleUpdate
 	if err != nil {
 		return
 	}
+	oldViewers := guildSession.getViewers(guildSession.getJoinedChannels())
 	guildSession.updateRole(role.Role)
+	guildSession.sendViewerChanges(oldViewers, guildSession.getViewers(guildSession.getJoinedChannels()))
 }
 
 func guildMemberAdd(session *discordgo.Session, member *discordgo.GuildMemberAdd) {
@@ -194,17 +276,11 @@ func guildMemberAdd(session *discordgo.Session, member *discordgo.GuildMemberAdd
 		if conn == nil {
 			continue
 		}
-		for ircChannel := range conn.channels {
-			channelName := guildSession.channelMap.GetName(ircChannel)
-			fmt.Println(channelName)
-			conn.sendJOIN(
-				conn.getNick(member.User),
-				convertDiscordUsernameToIRCRealname(member.Member.User.Username),
-				member.Member.User.ID,
-				channelName,
-			)
+		for _, channel := range guildSession.getJoinedChannels() {
+			if guildSession.canView(member.Member, channel) {
+				sendVisibilityChangeFromDiscordToIRC(conn, channel, member.User, true)
+			}
 		}
-		return
 	}
 }
 
@@ -215,24 +291,68 @@ func guildMemberUpdate(session *discordgo.Session, member *discordgo.GuildMember
 		return
 	}
 
+	// the cached member is the one State already updated, so only the roles we copied are old
 	oldNick := guildSession.getNick(member.User)
-	guildSession.updateMember(member.Member)
+	oldRoles, known := guildSession.updateMember(member.Member)
+	var oldMember *discordgo.Member
+	if known {
+		oldMember = &discordgo.Member{}
+		*oldMember = *member.Member
+		oldMember.Roles = oldRoles
+	}
+	if member.User.ID == guildSession.selfUser.ID {
+		guildSession.selfMember = member.Member
+	}
 	newNick := guildSession.getNick(member.User)
-	if oldNick != newNick {
-		for _, conn := range guildSession.conns {
-			if conn == nil {
-				continue
-			}
+	for _, conn := range guildSession.conns {
+		if conn == nil {
+			continue
+		}
+		if oldNick != newNick {
 			conn.sendNICK(
 				oldNick,
 				oldNick,
 				member.User.ID,
 				newNick,
 			)
-			return
+			if member.User.ID == conn.selfUser.ID {
+				conn.setClientNick(newNick)
+			}
+		}
+		if oldMember == nil {
+			continue
+		}
+		conn.channelsMutex.RLock()
+		channelIDs := []string{}
+		for channelID, joined := range conn.channels {
+			if joined {
+				channelIDs = append(channelIDs, channelID)
+			}
+		}
+		conn.channelsMutex.RUnlock()
+		for _, channelID := range channelIDs {
+			channel, err := guildSession.getChannel(channelID)
+			if err != nil {
+				continue
+			}
+			visible := guildSession.canView(member.Member, channel)
+			if visible != guildSession.canView(oldMember, channel) {
+				sendVisibilityChangeFromDiscordToIRC(conn, channel, member.User, visible)
+				if !visible {
+					continue
+				}
+			}
+			changes, count := diffModes(guildSession.getMemberModes(oldMember, channel), guildSession.getMemberModes(member.Member, channel))
+			if count == 0 {
+				continue
+			}
+			params := []string{}
+			for i := 0; i < count; i++ {
+				params = append(params, newNick)
+			}
+			conn.sendMODE(guildSession.getChannelName(channel), changes, params...)
 		}
 	}
-	// TODO: handle role changes?
 }
 
 func guildMemberRemove(session *discordgo.Session, member *discordgo.GuildMemberRemove) {
@@ -241,6 +361,8 @@ func guildMemberRemove(session *discordgo.Session, member *discordgo.GuildMember
 	if err != nil {
 		return
 	}
+	// get the nick before it's removed from the userMap
+	nick := guildSession.getNick(member.User)
 	guildSession.removeMember(member.Member)
 	fmt.Printf("username: %s#%s | nick: %s\n", member.User.Username, member.User.Discriminator, getIRCNick(member.Nick))
 	for _, conn := range guildSession.conns {
@@ -248,12 +370,37 @@ func guildMemberRemove(session *discordgo.Session, member *discordgo.GuildMember
 			continue
 		}
 		conn.sendQUIT(
-			conn.getNick(member.User),
+			nick,
 			convertDiscordUsernameToIRCRealname(member.Member.User.Username),
 			member.Member.User.ID,
 			"Quit",
 		)
+	}
+}
+
+func presenceUpdate(session *discordgo.Session, presence *discordgo.PresenceUpdate) {
+	guildSession, err := getGuildSession(session.Token, presence.GuildID)
+	if err != nil || presence.User == nil {
+		return
+	}
+	oldPresence := guildSession.updatePresence(&presence.Presence)
+	if guildSession.selfUser != nil && presence.User.ID == guildSession.selfUser.ID {
 		return
 	}
-	// TODO: send part like guildMemberAdd
+
+	awayMessage := getAwayMessage(&presence.Presence)
+	if getAwayMessage(oldPresence) == awayMessage {
+		return
+	}
+
+	nick := guildSession.userMap.GetName(presence.User.ID)
+	if nick == "" {
+		return
+	}
+	for _, conn := range guildSession.conns {
+		if conn == nil || !conn.user.supportedCapabilities["away-notify"] {
+			continue
+		}
+		conn.sendAWAY(nick, nick, presence.User.ID, awayMessage)
+	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLooksLikeCode(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  bool
+	}{
+		{"go", []string{"func main() {", "\tfmt.Println(\"hi\")", "}"}, true},
+		{"c", []string{"#include <stdio.h>", "int x = 1;", "return 0;"}, true},
+		{"python", []string{"def foo(x):", "    return x", "foo(1)"}, true},
+		{"java stack trace", []string{"java.lang.NullPointerException", "\tat com.example.Foo.bar(Foo.java:12)", "\tat com.example.Foo.main(Foo.java:5)"}, true},
+		{"python traceback", []string{"Traceback (most recent call last):", "  File \"foo.py\", line 1, in <module>", "NameError: name 'x' is not defined"}, true},
+		{"prose", []string{"see you at noon", "at least I think so", "bring snacks"}, false},
+		{"prose with semicolons", []string{"I went home; it was late;", "then I slept;", "the end"}, false},
+		{"prose with brackets", []string{"that's fine (I think)", "ok [sure]", "bye"}, false},
+		{"one line of code in three", []string{"try this:", "x = 1;", "does it work?"}, false},
+		{"half", []string{"x = 1;", "does it work?"}, true},
+	}
+	for _, test := range tests {
+		if got := looksLikeCode(test.lines); got != test.want {
+			t.Errorf("%s: looksLikeCode(%q) = %v, want %v", test.name, test.lines, got, test.want)
+		}
+	}
+}
+
+func TestSplitDiscordMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		maxLength int
+		want      []string
+	}{
+		{"short", "hello", 10, []string{"hello"}},
+		{"exact", "0123456789", 10, []string{"0123456789"}},
+		{"between lines", "hello\nworld, again", 12, []string{"hello", "world, again"}},
+		{"between words", "hello world again", 12, []string{"hello world", "again"}},
+		{"no spaces", "0123456789abc", 10, []string{"0123456789", "abc"}},
+		{"multibyte", "ééééé ééééé", 6, []string{"ééééé", "ééééé"}},
+		{"prefers lines", "a b\nc d e f", 8, []string{"a b", "c d e f"}},
+	}
+	for _, test := range tests {
+		got := splitDiscordMessage(test.content, test.maxLength)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitDiscordMessage(%q, %d) = %q, want %q", test.name, test.content, test.maxLength, got, test.want)
+		}
+		for _, part := range got {
+			if n := len([]rune(part)); n > test.maxLength {
+				t.Errorf("%s: part %q is %d characters, over %d", test.name, part, n, test.maxLength)
+			}
+		}
+		if joined := strings.Join(got, ""); len(joined) > len(test.content) {
+			t.Errorf("%s: parts %q are longer than the content", test.name, got)
+		}
+	}
+}
@@ -3,15 +3,161 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
+	"github.com/tadeokondrak/irc"
 )
 
+func getTag(m *irc.Message, key string) string {
+	if m.Tags == nil {
+		return ""
+	}
+	value, _ := m.Tags.Get(key)
+	return value
+}
+
+// hasTag reports whether a message has a tag, for tags like draft/multiline-concat that don't have values
+func hasTag(m *irc.Message, key string) bool {
+	if m.Tags == nil {
+		return false
+	}
+	_, exists := m.Tags.Get(key)
+	return exists
+}
+
+// sameTags reports whether two messages have the same tags
+func sameTags(a *irc.Message, b *irc.Message) bool {
+	var aTags, bTags irc.Tags
+	if a.Tags != nil {
+		aTags = *a.Tags
+	}
+	if b.Tags != nil {
+		bTags = *b.Tags
+	}
+	if len(aTags) != len(bTags) {
+		return false
+	}
+	for key, value := range aTags {
+		if other, exists := bTags[key]; !exists || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+var tagValueEscaper = strings.NewReplacer(`\`, `\\`, ";", `\:`, " ", `\s`, "\r", `\r`, "\n", `\n`)
+
+// formatAttributes formats key=value pairs like message tags, e.g. for BOUNCER NETWORK
+func formatAttributes(keys []string, values map[string]string) string {
+	attributes := make([]string, 0, len(keys))
+	for _, key := range keys {
+		attributes = append(attributes, key+"="+tagValueEscaper.Replace(values[key]))
+	}
+	return strings.Join(attributes, ";")
+}
+
+// limits advertised in RPL_ISUPPORT
+const (
+	maxChannelNameLength = 50   // channel names are truncated to this, before any suffix
+	maxTopicLength       = 1024 // Discord's channel topic limit
+	maxKickLength        = 512  // Discord's audit log reason limit
+	maxAwayLength        = 128  // Discord's custom status limit
+	maxLineLength        = 512  // including the CRLF, but not tags
+	maxISupportTokens    = 13   // per RPL_ISUPPORT line
+)
+
+// maxThreadNameLength is the longest #parent/thread name. Both names can get a suffix, up to "#99",
+// if they're already taken, and the thread's name doesn't have its own #.
+const (
+	maxNameSuffixLength = 3
+	maxThreadNameLength = maxChannelNameLength + maxNameSuffixLength + len("/") + maxChannelNameLength - len("#") + maxNameSuffixLength
+)
+
+// draft/multiline limits advertised in CAP LS, and how many batches can be open at once
+const (
+	maxMultilineBytes   = 4096
+	maxMultilineLines   = 100
+	maxMultilineBatches = 10
+)
+
+// membership modes and their NAMES prefixes, highest first
+const (
+	membershipModes    = "ohv"
+	membershipPrefixes = "@%+"
+)
+
+// getMembershipPrefix returns the prefix for the highest of a user's membership modes
+func getMembershipPrefix(modes string) string {
+	for i := range membershipModes {
+		if strings.IndexByte(modes, membershipModes[i]) >= 0 {
+			return string(membershipPrefixes[i])
+		}
+	}
+	return ""
+}
+
+// diffModes returns the mode changes from oldModes to newModes, e.g. "+o-v", and how many there are
+func diffModes(oldModes string, newModes string) (changes string, count int) {
+	var added, removed string
+	for _, mode := range membershipModes {
+		if strings.ContainsRune(newModes, mode) && !strings.ContainsRune(oldModes, mode) {
+			added += string(mode)
+		} else if !strings.ContainsRune(newModes, mode) && strings.ContainsRune(oldModes, mode) {
+			removed += string(mode)
+		}
+	}
+	if added != "" {
+		changes += "+" + added
+	}
+	if removed != "" {
+		changes += "-" + removed
+	}
+	return changes, len(added) + len(removed)
+}
+
+// sedEdit is a s/pattern/replacement/ correction typed by an IRC user
+type sedEdit struct {
+	reference   string
+	pattern     string
+	replacement string
+	global      bool
+}
+
+var patternSedEdit = regexp.MustCompile(`^(?:([0-9]+) )?s/((?:[^/\\]|\\.)+)/((?:[^/\\]|\\.)*)/(g?)$`)
+
+func parseSedEdit(text string) *sedEdit {
+	matches := patternSedEdit.FindStringSubmatch(strings.TrimSpace(text))
+	if matches == nil {
+		return nil
+	}
+	unescape := strings.NewReplacer(`\/`, "/", `\\`, `\`)
+	return &sedEdit{
+		reference:   matches[1],
+		pattern:     unescape.Replace(matches[2]),
+		replacement: unescape.Replace(matches[3]),
+		global:      matches[4] == "g",
+	}
+}
+
+func (e *sedEdit) apply(content string) (edited string, ok bool) {
+	if !strings.Contains(content, e.pattern) {
+		return content, false
+	}
+	n := 1
+	if e.global {
+		n = -1
+	}
+	return strings.Replace(content, e.pattern, e.replacement, n), true
+}
+
 func convertDiscordChannelNameToIRC(discordName string) (IRCName string) {
 	re := regexp.MustCompile(`[^a-zA-Z0-9\-_#&]+`)
 	cleaned := re.ReplaceAllString(discordName, "")
-	IRCName = truncate("#"+cleaned, 50)
+	IRCName = truncate("#"+cleaned, maxChannelNameLength)
 
 	if IRCName == "" {
 		IRCName = "_"
@@ -65,18 +211,11 @@ var (
 	patternNicks    = regexp.MustCompile("<@![^>]*>")
 	patternRoles    = regexp.MustCompile("<@&[^>]*>")
 	patternEmoji    = regexp.MustCompile("<a?:[^>]*:[^>]*>")
-	//patternBold          = regexp.MustCompile(`\*{2}([^*].*)\*{2}`)
-	//patternItalic1       = regexp.MustCompile(`\*([^*].*)\*`)
-	//patternUnderline     = regexp.MustCompile(`_{2}([^_].*)_{2}`)
-	//patternItalic2       = regexp.MustCompile(`_([^_].*)_`)
-	//patternSpoiler       = regexp.MustCompile(`\|{2}([^|].*)\|{2}`)
-	//patternSmallCode     = regexp.MustCompile(`\x60([^\x60]*)\x60`)
-	//patternStrikethrough = regexp.MustCompile(`~{2}([^~].*)~{2}`)
 )
 
 func convertDiscordContentToIRC(text string, c *ircConn) (content string) {
-	content = text
-	content = patternRoles.ReplaceAllStringFunc(content, func(mention string) string {
+	content = convertDiscordMarkdownToIRC(text)
+	content = replaceMentions(content, patternRoles, func(mention string, restore string) string {
 		fmt.Printf("processing role mention %s\n", mention)
 		role, err := c.getRole(mention[3 : len(mention)-1])
 		if err != nil {
@@ -89,104 +228,368 @@ func convertDiscordContentToIRC(text string, c *ircConn) (content string) {
 		}
 		fmt.Printf("role found: %s\n", c.getRoleName(role))
 
-		roleColour := "\x0303\x02"
-		colourReset := "\x0F"
+		roleColour := "\x0f\x0303\x02"
 		for _, _role := range c.guildSession.selfMember.Roles {
 			if role.ID == _role {
-				nickColour := "\x0312\x02"
-				return fmt.Sprintf("%s&%s%s (%s@%s%s)", roleColour, c.getRoleName(role), colourReset, nickColour, c.getNick(c.guildSession.selfMember.User), colourReset)
+				nickColour := "\x0f\x0312\x02"
+				return fmt.Sprintf("%s&%s%s (%s@%s%s)", roleColour, c.getRoleName(role), restore, nickColour, c.getNick(c.guildSession.selfMember.User), restore)
 			}
 		}
 
-		return fmt.Sprintf("%s&%s%s", roleColour, c.getRoleName(role), colourReset)
+		return fmt.Sprintf("%s&%s%s", roleColour, c.getRoleName(role), restore)
 	})
 
 	// TODO: remove this copy/paste shit
-	content = patternNicks.ReplaceAllStringFunc(content, func(mention string) string {
+	content = replaceMentions(content, patternNicks, func(mention string, restore string) string {
 		user, err := c.getUser(mention[3 : len(mention)-1])
 		if err != nil {
 			return mention
 		}
 
-		colourReset := "\x0F"
 		if user.ID == c.selfUser.ID {
-			colour := "\x0312\x02"
-			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), colourReset)
+			colour := "\x0f\x0312\x02"
+			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), restore)
 		} else {
-			colour := "\x0302\x02"
-			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), colourReset)
+			colour := "\x0f\x0302\x02"
+			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), restore)
 		}
 	})
 
-	content = patternUsers.ReplaceAllStringFunc(content, func(mention string) string {
+	content = replaceMentions(content, patternUsers, func(mention string, restore string) string {
 		user, err := c.getUser(mention[2 : len(mention)-1])
 		if err != nil {
 			return mention
 		}
 
-		colourReset := "\x0F"
 		if user.ID == c.selfUser.ID {
-			colour := "\x0312\x02"
-			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), colourReset)
+			colour := "\x0f\x0312\x02"
+			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), restore)
 		} else {
-			colour := "\x0302\x02"
-			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), colourReset)
+			colour := "\x0f\x0302\x02"
+			return fmt.Sprintf("%s@%s%s", colour, c.getNick(user), restore)
 		}
 	})
 
-	content = patternChannels.ReplaceAllStringFunc(content, func(mention string) string {
+	content = replaceMentions(content, patternChannels, func(mention string, restore string) string {
 		channel, err := c.getChannel(mention[2 : len(mention)-1])
 		if err != nil {
 			return mention
 		}
 		// TODO: remove # from channel name and add it back here
-		return fmt.Sprintf("\x0304\x02%s\x03\x02", c.getChannelName(channel))
+		return fmt.Sprintf("\x0f\x0304\x02%s%s", c.getChannelName(channel), restore)
 	})
 
-	content = patternEmoji.ReplaceAllStringFunc(content, func(match string) string {
-		return fmt.Sprintf("\x0305:%s:\x03", match[strings.Index(match, ":")+1:strings.LastIndex(match, ":")])
+	content = replaceMentions(content, patternEmoji, func(match string, restore string) string {
+		return fmt.Sprintf("\x0305:%s:%s", match[strings.Index(match, ":")+1:strings.LastIndex(match, ":")], restore)
 	})
 
-	// content = patternBold.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x02%s\x02", match[2:len(match)-2])
-	// })
+	return
+}
+
+// replaceMentions replaces what pattern matches in content with what replace returns. Mentions are
+// formatted, so replace is given the codes that restore the formatting in effect where the mention was.
+func replaceMentions(content string, pattern *regexp.Regexp, replace func(mention string, restore string) string) string {
+	var builder strings.Builder
+	var formatting ircFormatting
+	last := 0
+	for _, match := range pattern.FindAllStringIndex(content, -1) {
+		before := content[last:match[0]]
+		builder.WriteString(before)
+		if newline := strings.LastIndexByte(before, '\n'); newline >= 0 { // formatting ends with the line
+			formatting = ircFormatting{}
+			before = before[newline+1:]
+		}
+		formatting.apply(before)
+
+		restore := formatReset + formatting.codes(content[match[1]:])
+		builder.WriteString(replace(content[match[0]:match[1]], restore))
+		last = match[1]
+	}
+	builder.WriteString(content[last:])
+	return builder.String()
+}
+
+// convertDiscordMessageToIRC returns the text of a message. System messages are returned as
+// what their author did, with isAction set, and should be sent as an ACTION.
+func convertDiscordMessageToIRC(m *discordgo.Message, c *ircConn) (ircContent string, isAction bool) {
+	// TODO: check if edited and put (edited) with low contrast
+	if action := getSystemMessageAction(c, m); action != "" {
+		return action, true
+	}
+
+	var lines []string
+	if m.Content != "" {
+		lines = append(lines, m.Content)
+	}
+	for _, embed := range m.Embeds {
+		// link previews only repeat what's in the message
+		if embed.Type != "rich" && embed.URL != "" && strings.Contains(m.Content, embed.URL) {
+			continue
+		}
+		lines = append(lines, convertDiscordEmbedToIRC(embed)...)
+	}
+	for _, attachment := range m.Attachments {
+		lines = append(lines, attachment.URL)
+	}
+	// stickers aren't parsed by discordgo, so only look for them in messages that look empty
+	if len(lines) == 0 && (m.Type == discordgo.MessageTypeDefault || m.Type == messageTypeReply) {
+		stickers, err := c.getStickers(m.ChannelID, m.ID)
+		if err != nil {
+			fmt.Println(err)
+		}
+		for _, sticker := range stickers {
+			lines = append(lines, "\x0306[sticker: "+sticker.Name+"]\x0f")
+		}
+	}
+	ircContent = convertDiscordContentToIRC(strings.Join(lines, "\n"), c)
+	return
+}
+
+// convertDiscordEmbedToIRC returns the lines of an embed, each quoted with a bar
+func convertDiscordEmbedToIRC(embed *discordgo.MessageEmbed) (lines []string) {
+	if embed.Author != nil && embed.Author.Name != "" {
+		lines = append(lines, "\x02"+embed.Author.Name+"\x02")
+	}
+	if embed.Title != "" && embed.URL != "" {
+		lines = append(lines, "\x02"+embed.Title+"\x02 "+embed.URL)
+	} else if embed.Title != "" {
+		lines = append(lines, "\x02"+embed.Title+"\x02")
+	} else if embed.URL != "" {
+		lines = append(lines, embed.URL)
+	}
+	if embed.Description != "" {
+		lines = append(lines, strings.Split(embed.Description, "\n")...)
+	}
+	for _, field := range embed.Fields {
+		values := strings.Split(field.Value, "\n")
+		lines = append(lines, "\x02"+field.Name+":\x02 "+values[0])
+		lines = append(lines, values[1:]...)
+	}
+	if embed.Image != nil && embed.Image.URL != "" {
+		lines = append(lines, embed.Image.URL)
+	} else if embed.Thumbnail != nil && embed.Thumbnail.URL != "" && embed.Thumbnail.URL != embed.URL {
+		lines = append(lines, embed.Thumbnail.URL)
+	}
+	if embed.Footer != nil && embed.Footer.Text != "" {
+		lines = append(lines, "\x0314"+embed.Footer.Text+"\x0f")
+	}
+
+	for i, line := range lines {
+		lines[i] = "\x0314|\x0f " + line
+	}
+	return
+}
 
-	// content = patternItalic1.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x1d%s\x1d", match[1:len(match)-1])
-	// })
+// ircFormatting is the formatting in effect at some point in a line
+type ircFormatting struct {
+	toggles string // bold, italic etc. codes that are on, in the order they were turned on
+	colour  string // the last colour code, empty for the default colours
+}
 
-	// content = patternUnderline.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x1f%s\x1f", match[2:len(match)-2])
-	// })
+func (f *ircFormatting) apply(text string) {
+	for i := 0; i < len(text); {
+		n := getFormattingUnitLength(text[i:])
+		code := text[i : i+n]
+		i += n
+
+		switch code[0] {
+		case formatBold[0], formatItalic[0], formatUnderline[0], formatStrikethrough[0], formatMonospace[0], formatReverse[0]:
+			if j := strings.IndexByte(f.toggles, code[0]); j >= 0 {
+				f.toggles = f.toggles[:j] + f.toggles[j+1:]
+			} else {
+				f.toggles += code[:1]
+			}
+		case formatReset[0]:
+			*f = ircFormatting{}
+		case formatColour[0], formatHexColour[0]:
+			// a code without a background keeps the old one
+			if comma := strings.IndexByte(f.colour, ','); len(code) > 1 && !strings.Contains(code, ",") && comma >= 0 && f.colour[0] == code[0] {
+				code += f.colour[comma:]
+			}
+			if len(code) == 1 {
+				code = ""
+			}
+			f.colour = code
+		}
+	}
+}
 
-	// content = patternItalic2.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x1d%s\x1d", match[1:len(match)-1])
-	// })
+// codes returns the codes that turn this formatting back on before text
+func (f *ircFormatting) codes(text string) string {
+	if f.colour == "" || text == "" || (text[0] != ',' && !strings.ContainsRune("0123456789ABCDEFabcdef", rune(text[0]))) {
+		return f.toggles + f.colour
+	}
+	// so text isn't read as part of the colour code
+	return f.toggles + f.colour + formatBold + formatBold
+}
 
-	// content = patternSpoiler.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x0301,01%s\x03", match[2:len(match)-2])
-	// })
+// getFormattingUnitLength returns the length of the character or formatting code at the start of text
+func getFormattingUnitLength(text string) int {
+	switch text[0] {
+	case formatColour[0]:
+		return 1 + len(patternColourCode.FindString(text[1:]))
+	case formatHexColour[0]:
+		return 1 + len(patternHexColour.FindString(text[1:]))
+	}
+	_, n := utf8.DecodeRuneInString(text)
+	return n
+}
 
-	// content = patternSmallCode.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x11%s\x11", match[1:len(match)-1])
-	// })
+// splitIRCLine splits a line into parts of at most maxBytes bytes, between words where it can.
+// Characters and colour codes are never cut, and each part starts with the formatting the last one ended with.
+// If the parts will be concatenated again, spaces are kept and the formatting isn't repeated.
+func splitIRCLine(line string, maxBytes int, concat bool) (parts []string) {
+	var formatting ircFormatting
+	for line != "" {
+		var prefix string
+		if !concat {
+			prefix = formatting.codes(line)
+		}
+		if len(prefix)+len(line) <= maxBytes {
+			if !concat && len(parts) > 0 {
+				line = strings.TrimRight(line, " ")
+			}
+			return append(parts, prefix+line)
+		}
 
-	// content = patternStrikethrough.ReplaceAllStringFunc(content, func(match string) string {
-	// 	return fmt.Sprintf("\x1e%s\x1e", match[2:len(match)-2])
-	// })
+		end, wordEnd := 0, 0
+		for end < len(line) {
+			n := getFormattingUnitLength(line[end:])
+			if len(prefix)+end+n > maxBytes {
+				break
+			}
+			end += n
+			if line[end-1] == ' ' {
+				wordEnd = end
+			}
+		}
+		if wordEnd > 0 {
+			end = wordEnd
+		} else if end == 0 { // not even one character fits
+			end = getFormattingUnitLength(line)
+		}
 
+		if concat {
+			parts = append(parts, line[:end])
+			line = line[end:]
+			continue
+		}
+		parts = append(parts, prefix+strings.TrimRight(line[:end], " "))
+		formatting.apply(line[:end])
+		line = strings.TrimLeft(line[end:], " ")
+	}
 	return
 }
 
-func convertDiscordMessageToIRC(m *discordgo.Message, c *ircConn) (ircContent string) {
-	// TODO: check if edited and put (edited) with low contrast
-	ircContent = m.Content
-	for _, attachment := range m.Attachments {
-		if ircContent != "" {
-			ircContent += "\n"
+// splitIRCAction is splitIRCLine for the text of an ACTION, which frames every part as an ACTION
+func splitIRCAction(text string, maxBytes int) []string {
+	const actionStart, actionEnd = "\x01ACTION ", "\x01"
+	parts := splitIRCLine(text, maxBytes-len(actionStart)-len(actionEnd), false)
+	for i, part := range parts {
+		parts[i] = actionStart + part + actionEnd
+	}
+	return parts
+}
+
+// listQuery holds the ELIST conditions of a LIST
+type listQuery struct {
+	masks       []string
+	notMasks    []string
+	topicMasks  []string
+	minUsers    int           // more users than this, -1 if unset
+	maxUsers    int           // fewer users than this, -1 if unset
+	minAge      time.Duration // created more than this long ago
+	maxAge      time.Duration // created less than this long ago, 0 if unset
+	minTopicAge time.Duration // topic set more than this long ago
+	maxTopicAge time.Duration // topic set less than this long ago, 0 if unset
+}
+
+// parseListQuery parses comma separated LIST conditions:
+// masks, !masks, >n and <n user counts, C>n and C<n ages and T>n and T<n topic ages in minutes,
+// and T:masks for topics, which isn't part of ELIST. Conditions we can't parse are ignored.
+func parseListQuery(param string) (query listQuery) {
+	query.minUsers = -1
+	query.maxUsers = -1
+	for _, condition := range strings.Split(param, ",") {
+		switch {
+		case condition == "":
+		case condition[0] == '>' || condition[0] == '<':
+			n, err := strconv.Atoi(condition[1:])
+			if err != nil {
+				continue
+			}
+			if condition[0] == '>' {
+				query.minUsers = n
+			} else {
+				query.maxUsers = n
+			}
+		case strings.HasPrefix(condition, "C>") || strings.HasPrefix(condition, "C<"):
+			n, err := strconv.Atoi(condition[2:])
+			if err != nil {
+				continue
+			}
+			if condition[1] == '>' {
+				query.minAge = time.Duration(n) * time.Minute
+			} else {
+				query.maxAge = time.Duration(n) * time.Minute
+			}
+		case strings.HasPrefix(condition, "T>") || strings.HasPrefix(condition, "T<"):
+			n, err := strconv.Atoi(condition[2:])
+			if err != nil {
+				continue
+			}
+			if condition[1] == '>' {
+				query.minTopicAge = time.Duration(n) * time.Minute
+			} else {
+				query.maxTopicAge = time.Duration(n) * time.Minute
+			}
+		case strings.HasPrefix(condition, "T:"):
+			query.topicMasks = append(query.topicMasks, condition[2:])
+		case condition[0] == '!':
+			query.notMasks = append(query.notMasks, condition[1:])
+		default:
+			query.masks = append(query.masks, condition)
 		}
-		ircContent += attachment.URL
 	}
-	ircContent = convertDiscordContentToIRC(ircContent, c)
 	return
 }
+
+// hasTopicAge reports whether the query needs to know when topics were set
+func (q *listQuery) hasTopicAge() bool {
+	return q.minTopicAge > 0 || q.maxTopicAge > 0
+}
+
+func (q *listQuery) match(name string, topic string, users int, created time.Time, topicSet time.Time) bool {
+	if q.minUsers >= 0 && users <= q.minUsers {
+		return false
+	}
+	if q.maxUsers >= 0 && users >= q.maxUsers {
+		return false
+	}
+	age := time.Since(created)
+	if age < q.minAge || (q.maxAge > 0 && age > q.maxAge) {
+		return false
+	}
+	if topicAge := time.Since(topicSet); q.hasTopicAge() && (topicAge < q.minTopicAge || (q.maxTopicAge > 0 && topicAge > q.maxTopicAge)) {
+		return false
+	}
+	for _, mask := range q.notMasks {
+		if matchMask(mask, name) {
+			return false
+		}
+	}
+	if !matchAnyMask(q.masks, name) || !matchAnyMask(q.topicMasks, topic) {
+		return false
+	}
+	return true
+}
+
+// matchAnyMask reports whether str matches one of the masks, or if there aren't any
+func matchAnyMask(masks []string, str string) bool {
+	for _, mask := range masks {
+		if matchMask(mask, str) {
+			return true
+		}
+	}
+	return len(masks) == 0
+}
@@ -8,7 +8,9 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/dustin/go-humanize"
 	"github.com/tadeokondrak/irc"
 )
@@ -21,64 +23,94 @@ type ircUser struct {
 	capBlocked            bool
 	supportsCap302        bool
 	supportedCapabilities map[string]bool
+	saslMechanism         string
+	saslBuffer            string
+	saslAuthenticated     bool
+	token                 string
+	guildID               string
+	networkID             string // guild bound with BOUNCER BIND
 }
 
 type ircConn struct {
 	*guildSession
-	channels             map[string]bool // map[channnelid]bool
-	channelsMutex        sync.RWMutex
-	passwordEntered      bool
-	loggedin             bool
-	clientPrefix         irc.Prefix
-	serverPrefix         irc.Prefix
-	latestPONG           string
-	recentlySentMessages map[string][]string
-	conn                 net.Conn
-	user                 ircUser
-	reader               *bufio.Reader
-	lastPING             string
-	lastPONG             string
+	channels                  map[string]bool // map[channnelid]bool
+	channelsMutex             sync.RWMutex
+	queries                   map[string]string // map[channelid]userid of DMs open in a guild conn
+	queriesMutex              sync.RWMutex
+	multilineBatches          map[string]*multilineBatch // map[reference]batch, only used by the read loop
+	pastes                    map[string]*paste          // map[target]paste
+	pasteSends                map[string]chan struct{}   // map[target]closed once the last send queued for it is done
+	pastesMutex               sync.Mutex
+	passwordEntered           bool
+	loggedin                  bool
+	clientPrefix              irc.Prefix // its nick can be changed by other conns, so use getClientPrefix
+	clientPrefixMutex         sync.RWMutex
+	serverPrefix              irc.Prefix
+	latestPONG                string
+	recentlySentMessages      map[string][]*sentMessage // map[channelid][]*sentMessage
+	recentlySentMessagesMutex sync.Mutex
+	conn                      net.Conn
+	user                      ircUser
+	reader                    *bufio.Reader
+	lastPING                  string
+	lastPONG                  string
 	sync.Mutex
 }
 
-func (c *ircConn) connect() (err error) {
+// parsePassword gets the token and guild from a `[serverpass:]token[:guildid]` password
+func (c *ircConn) parsePassword() (token string, guildID string, err error) {
 	args := strings.Split(c.user.password, ":")
 	if len(args) < 1 || (*serverPass != "" && len(args) < 2) { // TODO: change this when we add DM support
-		return errors.New("Invalid password (not enough arguments)")
+		return "", "", errors.New("Invalid password (not enough arguments)")
 	}
 
 	if *serverPass != "" {
 		if args[0] != *serverPass {
-			return errors.New("Invalid password (incorrect server password)")
+			return "", "", errors.New("Invalid password (incorrect server password)")
 		}
 		args = args[1:]
 	}
 
-	token := args[0]
+	token = args[0]
 
-	var guildID string
 	var fields []string
 	if len(args) > 1 {
 		fields = append(fields, args[1])
 	}
+	return token, c.findGuildID(fields...), nil
+}
+
+// findGuildID returns the first field that looks like a guild ID, also checking the nick and realname
+func (c *ircConn) findGuildID(fields ...string) (guildID string) {
 	fields = append(fields, c.user.nick, c.user.realname)
 	for _, field := range fields {
 		if _, err := strconv.Atoi(field); err == nil && len(field) >= 18 {
-			guildID = field
-			break
+			return field
 		}
 	}
+	return ""
+}
 
-	guildSession, err := getGuildSession(token, guildID)
-	if err != nil {
-		guildSession, err = newGuildSession(token, guildID)
+func (c *ircConn) connect() (err error) {
+	token, guildID := c.user.token, c.user.guildID
+	if !c.user.saslAuthenticated {
+		token, guildID, err = c.parsePassword()
 		if err != nil {
-			c.sendNOTICE("Failed to connect to Discord. Check if your token is correct")
-			c.close()
 			return err
 		}
-	} else {
-		fmt.Println("found existing guild session")
+	} else if *serverPass != "" && c.user.password != *serverPass {
+		return errors.New("Invalid password (incorrect server password)")
+	}
+
+	if c.user.networkID != "" {
+		guildID = c.user.networkID
+	}
+
+	guildSession, err := findGuildSession(token, guildID)
+	if err != nil {
+		c.sendNOTICE("Failed to connect to Discord. Check if your token is correct")
+		c.close()
+		return err
 	}
 
 	if guildSession == nil {
@@ -93,11 +125,13 @@ func (c *ircConn) connect() (err error) {
 	c.guildSession.addConn(c)
 	c.loggedin = true
 
+	c.clientPrefixMutex.Lock()
 	c.clientPrefix = irc.Prefix{
 		Name: c.getNick(c.selfUser),
 		User: convertDiscordUsernameToIRCRealname(c.selfUser.Username),
 		Host: c.selfUser.ID,
 	}
+	c.clientPrefixMutex.Unlock()
 
 	return
 }
@@ -124,9 +158,12 @@ func (c *ircConn) register() (err error) {
 	c.sendRPL(irc.RPL_YOURHOST, fmt.Sprintf("Your host is %[1]s, running version IRCdiscord-%[2]s", serverhostname, version))
 	c.sendRPL(irc.RPL_CREATED, fmt.Sprintf("This server was created %s", humanize.Time(startTime)))
 	c.sendRPL(irc.RPL_MYINFO, c.serverPrefix.Host, "IRCdiscord-"+version)
-	c.sendRPL(irc.RPL_ISUPPORT, "NICKLEN=32 MAXNICKLEN=36 AWAYLEN=0 KICKLEN=0 CHANTYPES=# are supported by this server") // TODO: change nicklen to be more accurate
-	// TODO: KICKLEN is the max ban reason in discord
-	// CHANNELLEN is the max channel name length
+	tokens := c.getISupportTokens()
+	for len(tokens) > 0 {
+		n := minInt(len(tokens), maxISupportTokens)
+		c.sendRPL(irc.RPL_ISUPPORT, append(tokens[:n:n], "are supported by this server")...)
+		tokens = tokens[n:]
+	}
 	//
 	// The server SHOULD then respond as though the client sent the LUSERS command and return the appropriate numerics
 	// c.handleLUSERS()
@@ -143,14 +180,276 @@ func (c *ircConn) register() (err error) {
 	return
 }
 
+// getISupportTokens returns the RPL_ISUPPORT tokens for this conn's session
+func (c *ircConn) getISupportTokens() []string {
+	network := "DirectMessages"
+	if c.guildSessionType == guildSessionGuild {
+		network = underscoreIfEmpty(removeWhitespace(c.guild.Name))
+	}
+	tokens := []string{
+		"AWAYLEN=" + strconv.Itoa(maxAwayLength),
+		"CASEMAPPING=ascii",
+		"CHANMODES=bq,,,nt",
+		"CHANNELLEN=" + strconv.Itoa(maxThreadNameLength),
+		"CHANTYPES=#",
+		"CHATHISTORY=" + strconv.Itoa(maxChatHistory),
+		"ELIST=CMNTU",
+		"KICKLEN=" + strconv.Itoa(maxKickLength),
+		"LINELEN=" + strconv.Itoa(maxLineLength),
+		"MAXNICKLEN=" + strconv.Itoa(maxNickLength+4), // room for the suffix added to duplicate nicks
+		"MSGREFTYPES=msgid,timestamp",
+		"NETWORK=" + network,
+		"NICKLEN=" + strconv.Itoa(maxNickLength),
+		"PREFIX=(" + membershipModes + ")" + membershipPrefixes,
+		"TARGMAX=JOIN:,PART:,KICK:,NAMES:1,WHOIS:1,PRIVMSG:1,NOTICE:1,TAGMSG:1",
+		"TOPICLEN=" + strconv.Itoa(maxTopicLength),
+		"WHOX",
+	}
+	if c.guildSessionType == guildSessionGuild && c.user.supportedCapabilities["soju.im/bouncer-networks"] {
+		tokens = append(tokens, "BOUNCER_NETID="+c.guild.ID)
+	}
+	return tokens
+}
+
+// isJoined reports whether messages for a channel should be sent to this conn.
+// The DM session has no channels to join, so everything goes through there.
+func (c *ircConn) isJoined(channelID string) bool {
+	if c.guildSession.guildSessionType != guildSessionGuild {
+		return true
+	}
+	c.channelsMutex.RLock()
+	defer c.channelsMutex.RUnlock()
+	return c.channels[channelID]
+}
+
+// openQuery returns the DM channel with a user, creating it if needed, and
+// delivers the DM's messages to this conn from then on
+func (c *ircConn) openQuery(userID string) (channelID string, err error) {
+	c.queriesMutex.RLock()
+	for channelID, queryUserID := range c.queries {
+		if queryUserID == userID {
+			c.queriesMutex.RUnlock()
+			return channelID, nil
+		}
+	}
+	c.queriesMutex.RUnlock()
+
+	channel, err := c.session.UserChannelCreate(userID)
+	if err != nil {
+		return "", err
+	}
+	c.addQuery(channel.ID, userID)
+	return channel.ID, nil
+}
+
+// getTargetChannel returns the Discord channel for a message target: a channel, or in a guild session
+// a nick, whose DM is opened. It's empty if there's no such channel or nick.
+func (c *ircConn) getTargetChannel(target string) (channelID string, err error) {
+	channelID = c.guildSession.channelMap.GetSnowflake(target)
+	if channelID != "" || c.guildSessionType != guildSessionGuild || strings.HasPrefix(target, "#") {
+		return channelID, nil
+	}
+	userID := c.guildSession.userMap.GetSnowflake(target)
+	if userID == "" {
+		return "", nil
+	}
+	return c.openQuery(userID)
+}
+
+func (c *ircConn) addQuery(channelID string, userID string) {
+	c.queriesMutex.Lock()
+	c.queries[channelID] = userID
+	c.queriesMutex.Unlock()
+}
+
+func (c *ircConn) hasQuery(channelID string) bool {
+	c.queriesMutex.RLock()
+	defer c.queriesMutex.RUnlock()
+	_, exists := c.queries[channelID]
+	return exists
+}
+
+// getQueryTarget returns the PRIVMSG target for a message in an open query: our nick,
+// or the other user's if we sent it. It's empty if the message isn't in a query.
+func (c *ircConn) getQueryTarget(m *discordgo.Message) string {
+	c.queriesMutex.RLock()
+	userID, exists := c.queries[m.ChannelID]
+	c.queriesMutex.RUnlock()
+	if !exists {
+		return ""
+	}
+	if m.Author != nil && m.Author.ID == c.selfUser.ID {
+		return c.userMap.GetName(userID)
+	}
+	return c.getClientPrefix().Name
+}
+
+// getClientPrefix returns a copy of the client's prefix
+func (c *ircConn) getClientPrefix() *irc.Prefix {
+	c.clientPrefixMutex.RLock()
+	defer c.clientPrefixMutex.RUnlock()
+	prefix := c.clientPrefix
+	return &prefix
+}
+
+func (c *ircConn) setClientNick(nick string) {
+	c.clientPrefixMutex.Lock()
+	c.clientPrefix.Name = nick
+	c.clientPrefixMutex.Unlock()
+}
+
+// multilineBatch is a draft/multiline batch the client is sending
+type multilineBatch struct {
+	start *irc.Message
+	text  strings.Builder
+	lines int
+	fail  []string // FAIL code and params, if the batch is invalid
+}
+
+// addToBatch adds a message to the multiline batch it's tagged with. It returns false if it isn't in one.
+// Messages in a batch that was refused or has ended are dropped rather than sent on their own.
+func (c *ircConn) addToBatch(m *irc.Message) bool {
+	if !hasTag(m, "batch") {
+		return false
+	}
+	batch, exists := c.multilineBatches[getTag(m, "batch")]
+	if !exists {
+		return true
+	}
+	if batch.fail != nil {
+		return true
+	}
+
+	switch {
+	case m.Command != irc.PRIVMSG || len(m.Params) < 2:
+		batch.fail = []string{"MULTILINE_INVALID", "Only PRIVMSG can be sent in a multiline batch"}
+	case m.Params[1] == "" && hasTag(m, "draft/multiline-concat"):
+		batch.fail = []string{"MULTILINE_INVALID", "Empty lines can't be concatenated"}
+	case !strings.EqualFold(m.Params[0], batch.start.Params[2]):
+		batch.fail = []string{"MULTILINE_INVALID_TARGET", batch.start.Params[2], m.Params[0], "Multiline batch has messages for more than one target"}
+	case batch.lines >= maxMultilineLines:
+		batch.fail = []string{"MULTILINE_MAX_LINES", strconv.Itoa(maxMultilineLines), "Multiline batch max-lines exceeded"}
+	case batch.text.Len()+len(m.Params[1]) > maxMultilineBytes:
+		batch.fail = []string{"MULTILINE_MAX_BYTES", strconv.Itoa(maxMultilineBytes), "Multiline batch max-bytes exceeded"}
+	}
+	if batch.fail != nil {
+		return true
+	}
+
+	if batch.lines > 0 && !hasTag(m, "draft/multiline-concat") {
+		batch.text.WriteString("\n")
+	}
+	batch.text.WriteString(m.Params[1])
+	batch.lines++
+	return true
+}
+
+// paste is lines sent to a target in quick succession, which are sent to Discord together
+type paste struct {
+	message *irc.Message // the first line
+	lines   []string
+	timer   *time.Timer
+}
+
+// bufferPRIVMSG holds a PRIVMSG until no more lines arrive for its target within -pastewindow.
+// CTCP, corrections and lines with different tags flush the paste and are sent on their own.
+func (c *ircConn) bufferPRIVMSG(m *irc.Message) {
+	if len(m.Params) < 2 {
+		go c.handlePRIVMSG(m)
+		return
+	}
+	target := m.Params[0]
+
+	c.pastesMutex.Lock()
+	defer c.pastesMutex.Unlock()
+	p, exists := c.pastes[target]
+	separate := strings.HasPrefix(m.Params[1], "\x01") || parseSedEdit(m.Params[1]) != nil
+	if exists && (separate || !sameTags(p.message, m)) {
+		p.timer.Stop()
+		delete(c.pastes, target)
+		c.queuePasteSend(target, func() { c.sendPaste(p) })
+		exists = false
+	}
+	if separate {
+		c.queuePasteSend(target, func() { c.handlePRIVMSG(m) })
+		return
+	}
+
+	if exists {
+		p.timer.Reset(*pasteWindow)
+	} else {
+		p = &paste{message: m}
+		p.timer = time.AfterFunc(*pasteWindow, func() { c.flushPaste(target, p) })
+		c.pastes[target] = p
+	}
+	p.lines = append(p.lines, m.Params[1])
+}
+
+// queuePasteSend runs send once everything queued for the target before it has been sent,
+// so messages reach Discord in the order they were sent. c.pastesMutex must be held.
+func (c *ircConn) queuePasteSend(target string, send func()) {
+	previous := c.pasteSends[target]
+	done := make(chan struct{})
+	c.pasteSends[target] = done
+	go func() {
+		if previous != nil {
+			<-previous
+		}
+		send()
+		close(done)
+
+		c.pastesMutex.Lock()
+		if c.pasteSends[target] == done {
+			delete(c.pasteSends, target)
+		}
+		c.pastesMutex.Unlock()
+	}()
+}
+
+func (c *ircConn) flushPaste(target string, p *paste) {
+	c.pastesMutex.Lock()
+	defer c.pastesMutex.Unlock()
+	if c.pastes[target] != p { // already sent
+		return
+	}
+	delete(c.pastes, target)
+	c.queuePasteSend(target, func() { c.sendPaste(p) })
+}
+
+// flushPastes sends every paste that's still waiting for more lines
+func (c *ircConn) flushPastes() {
+	c.pastesMutex.Lock()
+	defer c.pastesMutex.Unlock()
+	for target, p := range c.pastes {
+		p.timer.Stop()
+		delete(c.pastes, target)
+		p := p
+		c.queuePasteSend(target, func() { c.sendPaste(p) })
+	}
+}
+
+// sendPaste sends the lines of a paste as one message, in a code block if they look like code
+func (c *ircConn) sendPaste(p *paste) {
+	text := strings.Join(p.lines, "\n")
+	if len(p.lines) > 1 && !strings.Contains(text, "```") && looksLikeCode(p.lines) {
+		text = "```\n" + text + "\n```"
+	}
+	c.handlePRIVMSG(&irc.Message{
+		Tags:    p.message.Tags,
+		Command: irc.PRIVMSG,
+		Params:  []string{p.message.Params[0], text},
+	})
+}
+
 func (c *ircConn) readyToRegister() bool {
-	if c.user.nick != "" && c.user.username != "" && c.user.realname != "" && c.user.password != "" && !c.user.capBlocked {
+	if c.user.nick != "" && c.user.username != "" && c.user.realname != "" && (c.user.password != "" || c.user.saslAuthenticated) && !c.user.capBlocked {
 		return true
 	}
 	return false
 }
 
 func (c *ircConn) close() (err error) {
+	c.flushPastes()
 	if c.guildSession != nil {
 		c.guildSession.removeConn(c)
 	}
@@ -162,7 +461,18 @@ func (c *ircConn) close() (err error) {
 
 func (c *ircConn) decode() (message *irc.Message, err error) {
 	netData, err := c.reader.ReadString('\n')
+	// the irc library doesn't parse tags, so split them off ourselves
+	var tags irc.Tags
+	if strings.HasPrefix(netData, "@") {
+		if i := strings.IndexByte(netData, ' '); i > 0 {
+			tags = irc.ParseTags(netData[1:i])
+			netData = netData[i+1:]
+		}
+	}
 	message = irc.ParseMessage(netData)
+	if message != nil && tags != nil {
+		message.Tags = &tags
+	}
 	if message != nil {
 		fmt.Printf("->%s\n", message.String())
 	}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"encoding/base64"
 	"fmt"
+	"math"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/google/uuid"
@@ -28,6 +33,435 @@ func (c *ircConn) handleWHOIS(m *irc.Message) {
 		return
 	}
 	c.sendRPL(irc.RPL_WHOISUSER, c.getNick(user), c.getRealname(user), user.ID, "*", user.String())
+	if awayMessage := getAwayMessage(c.getPresence(user.ID)); awayMessage != "" {
+		c.sendRPL(irc.RPL_AWAY, c.getNick(user), awayMessage)
+	}
+	c.sendRPL(irc.RPL_ENDOFWHOIS, c.getNick(user), "End of /WHOIS list")
+}
+
+func (c *ircConn) handleWHO(m *irc.Message) {
+	mask := "*"
+	if len(m.Params) > 0 && m.Params[0] != "" && m.Params[0] != "0" {
+		mask = m.Params[0]
+	}
+
+	// WHOX: WHO <mask> %<fields>[,<token>]
+	fields, token := "", "0"
+	if len(m.Params) > 1 && strings.HasPrefix(m.Params[1], "%") {
+		fields = m.Params[1][1:]
+		if i := strings.Index(fields, ","); i >= 0 {
+			fields, token = fields[:i], fields[i+1:]
+		}
+	}
+
+	if channelID := c.guildSession.channelMap.GetSnowflake(mask); channelID != "" {
+		for _, user := range c.getChannelUsers(channelID) {
+			c.sendWHOReply(mask, user, fields, token)
+		}
+	} else {
+		for nick, userID := range c.guildSession.userMap.GetSnowflakeMap() {
+			user := c.getKnownUser(userID)
+			if user == nil {
+				continue
+			}
+			if matchMask(mask, nick) || matchMask(mask, user.ID) || matchMask(mask, user.Username) {
+				c.sendWHOReply("*", user, fields, token)
+			}
+		}
+	}
+
+	c.sendRPL(irc.RPL_ENDOFWHO, mask, "End of /WHO list")
+}
+
+// sendWHOReply sends RPL_WHOREPLY, or RPL_WHOSPCRPL with the requested fields for WHOX
+func (c *ircConn) sendWHOReply(channel string, user *discordgo.User, fields string, token string) {
+	const RPL_WHOSPCRPL = "354"
+	if user == nil {
+		return
+	}
+	nick := c.getNick(user)
+	username := convertDiscordUsernameToIRCRealname(user.Username)
+	flags := "H"
+	if getAwayMessage(c.getPresence(user.ID)) != "" {
+		flags = "G"
+	}
+	if channelID := c.guildSession.channelMap.GetSnowflake(channel); channelID != "" {
+		if discordChannel, err := c.getChannel(channelID); err == nil {
+			flags += getMembershipPrefix(c.getUserModes(discordChannel, user.ID))
+		}
+	}
+
+	if fields == "" {
+		c.sendRPL(irc.RPL_WHOREPLY, channel, username, user.ID, serverhostname, nick, flags, "0 "+user.String())
+		return
+	}
+
+	params := []string{}
+	for _, field := range "tcuihsnfdlaor" { // WHOX replies are always in this order
+		if !strings.ContainsRune(fields, field) {
+			continue
+		}
+		switch field {
+		case 't':
+			params = append(params, token)
+		case 'c':
+			params = append(params, channel)
+		case 'u':
+			params = append(params, username)
+		case 'i':
+			params = append(params, "255.255.255.255")
+		case 'h':
+			params = append(params, user.ID)
+		case 's':
+			params = append(params, serverhostname)
+		case 'n':
+			params = append(params, nick)
+		case 'f':
+			params = append(params, flags)
+		case 'd':
+			params = append(params, "0")
+		case 'l':
+			params = append(params, "0")
+		case 'a':
+			params = append(params, convertDiscordUsernameToIRCUser(user.Username))
+		case 'o':
+			params = append(params, "n/a")
+		case 'r':
+			params = append(params, user.String())
+		}
+	}
+	c.sendRPL(RPL_WHOSPCRPL, params...)
+}
+
+func (c *ircConn) handleMODE(m *irc.Message) {
+	const RPL_CREATIONTIME = "329"
+	if len(m.Params) < 1 {
+		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.MODE, "Not enough parameters")
+		return
+	}
+
+	target := m.Params[0]
+	channelID := c.guildSession.channelMap.GetSnowflake(target)
+	if channelID == "" {
+		if strings.EqualFold(target, c.getClientPrefix().Name) {
+			c.sendRPL(irc.RPL_UMODEIS, "+")
+			return
+		}
+		if c.guildSession.userMap.GetSnowflake(target) != "" {
+			c.sendERR(irc.ERR_USERSDONTMATCH, "Can't change mode for other users")
+			return
+		}
+		c.sendERR(irc.ERR_NOSUCHCHANNEL, target, "No such channel")
+		return
+	}
+
+	if len(m.Params) < 2 {
+		c.sendRPL(irc.RPL_CHANNELMODEIS, target, "+nt")
+		c.sendRPL(RPL_CREATIONTIME, target, strconv.FormatInt(getTimeFromSnowflake(channelID).Unix(), 10))
+		return
+	}
+
+	args := m.Params[2:]
+	adding := true
+	for _, mode := range m.Params[1] {
+		switch mode {
+		case '+':
+			adding = true
+		case '-':
+			adding = false
+		case 'b', 'q':
+			if len(args) == 0 {
+				if mode == 'b' {
+					c.sendBanList(target)
+				} else {
+					// Discord doesn't tell user accounts who is timed out
+					c.sendRPL(RPL_ENDOFQUIETLIST, target, "q", "End of channel quiet list")
+				}
+				continue
+			}
+			mask := args[0]
+			args = args[1:]
+			if mode == 'b' {
+				c.setBan(target, mask, adding)
+			} else {
+				c.setTimeout(target, mask, adding)
+			}
+		case 'o', 'h', 'v':
+			if len(args) > 0 {
+				args = args[1:]
+			}
+			c.sendERR(irc.ERR_CHANOPRIVSNEEDED, target, "Roles can only be changed on Discord")
+		default:
+			c.sendERR(irc.ERR_UNKNOWNMODE, string(mode), "is unknown mode char to me")
+		}
+	}
+}
+
+const RPL_ENDOFQUIETLIST = "729"
+
+// checkPermission sends ERR_CHANOPRIVSNEEDED and returns false if we're missing a permission.
+// Kicks, bans and timeouts apply to the whole guild, so channel overwrites don't count.
+func (c *ircConn) checkPermission(channelName string, permission int64) bool {
+	if c.guildSessionType != guildSessionGuild {
+		c.sendERR(irc.ERR_CHANOPRIVSNEEDED, channelName, "There's nothing to moderate in DMs")
+		return false
+	}
+
+	// owners and admins get discordgo.PermissionAll, which stops before newer permissions
+	permissions := int64(c.getPermissions(c.selfMember, nil))
+	if permissions&discordgo.PermissionAdministrator != 0 {
+		return true
+	}
+	if permission > math.MaxInt32 {
+		var err error
+		permissions, err = c.getMemberPermissions(c.selfMember)
+		if err != nil {
+			c.sendNOTICE("There was an error getting your permissions from Discord.")
+			fmt.Println(err)
+			return false
+		}
+	}
+	if permissions&permission == 0 {
+		c.sendERR(irc.ERR_CHANOPRIVSNEEDED, channelName, "You don't have the Discord permission to do that")
+		return false
+	}
+	return true
+}
+
+// sendModerationERR turns a Discord error from a moderation action into the closest IRC numeric
+func (c *ircConn) sendModerationERR(err error, channelName string, nick string) {
+	if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil {
+		switch restErr.Message.Code {
+		case discordgo.ErrCodeMissingPermissions, discordgo.ErrCodeMissingAccess:
+			c.sendERR(irc.ERR_CHANOPRIVSNEEDED, channelName, "You're not allowed to do that on Discord")
+			return
+		case discordgo.ErrCodeUnknownMember:
+			c.sendERR(irc.ERR_USERNOTINCHANNEL, nick, channelName, "They aren't on that channel")
+			return
+		case discordgo.ErrCodeUnknownUser, errCodeUnknownBan:
+			c.sendERR(irc.ERR_NOSUCHNICK, nick, "No such nick")
+			return
+		}
+	}
+	c.sendNOTICE("There was an error talking to Discord.")
+	fmt.Println(err)
+}
+
+// getBanMask returns the mask a banned Discord user is listed under
+func getBanMask(user *discordgo.User) string {
+	return getIRCNick(user.Username) + "!*@" + user.ID
+}
+
+// resolveMask finds the user a nick or nick!user@host mask is for. The host is the user ID.
+func (c *ircConn) resolveMask(mask string) (userID string) {
+	nick := mask
+	if i := strings.Index(mask, "!"); i >= 0 {
+		nick = mask[:i]
+	}
+	if i := strings.LastIndex(mask, "@"); i >= 0 {
+		host := mask[i+1:]
+		if _, err := strconv.ParseUint(host, 10, 64); err == nil {
+			return host
+		}
+		if i < len(nick) {
+			nick = nick[:i]
+		}
+	}
+	return c.guildSession.userMap.GetSnowflake(nick)
+}
+
+func (c *ircConn) sendBanList(channelName string) {
+	if !c.checkPermission(channelName, discordgo.PermissionBanMembers) {
+		return
+	}
+	bans, err := c.session.GuildBans(c.guild.ID)
+	if err != nil {
+		c.sendModerationERR(err, channelName, "")
+		return
+	}
+	for _, ban := range bans {
+		c.sendRPL(irc.RPL_BANLIST, channelName, getBanMask(ban.User))
+	}
+	c.sendRPL(irc.RPL_ENDOFBANLIST, channelName, "End of channel ban list")
+}
+
+func (c *ircConn) setBan(channelName string, mask string, ban bool) {
+	if !c.checkPermission(channelName, discordgo.PermissionBanMembers) {
+		return
+	}
+
+	userID := c.resolveMask(mask)
+	if userID == "" && !ban {
+		// banned users aren't in the guild anymore, so look through the bans
+		bans, err := c.session.GuildBans(c.guild.ID)
+		if err != nil {
+			c.sendModerationERR(err, channelName, mask)
+			return
+		}
+		for _, ban := range bans {
+			if matchMask(mask, getBanMask(ban.User)) {
+				userID = ban.User.ID
+				break
+			}
+		}
+	}
+	if userID == "" {
+		c.sendERR(irc.ERR_NOSUCHNICK, mask, "No such nick")
+		return
+	}
+
+	var err error
+	if ban {
+		err = c.session.GuildBanCreate(c.guild.ID, userID, 0)
+	} else {
+		err = c.session.GuildBanDelete(c.guild.ID, userID)
+	}
+	if err != nil {
+		c.sendModerationERR(err, channelName, mask)
+		return
+	}
+
+	if ban {
+		c.sendMODE(channelName, "+b", mask)
+	} else {
+		c.sendMODE(channelName, "-b", mask)
+	}
+}
+
+// setTimeout maps the quiet list mode to Discord timeouts
+func (c *ircConn) setTimeout(channelName string, mask string, timeout bool) {
+	if !c.checkPermission(channelName, permissionModerateMembers) {
+		return
+	}
+
+	userID := c.resolveMask(mask)
+	if userID == "" {
+		c.sendERR(irc.ERR_NOSUCHNICK, mask, "No such nick")
+		return
+	}
+
+	var until *time.Time
+	if timeout {
+		date := time.Now().Add(*timeoutDuration)
+		until = &date
+	}
+	err := c.setMemberTimeout(userID, until)
+	if err != nil {
+		c.sendModerationERR(err, channelName, mask)
+		return
+	}
+
+	if timeout {
+		c.sendMODE(channelName, "+q", mask)
+	} else {
+		c.sendMODE(channelName, "-q", mask)
+	}
+}
+
+// handleTHREAD creates a thread: THREAD <channel> <msgid|*> :<name>
+func (c *ircConn) handleTHREAD(m *irc.Message) {
+	const THREAD = "THREAD" // TODO: put in irc lib fork
+	if len(m.Params) < 3 || m.Params[2] == "" {
+		c.sendFAIL(THREAD, "NEED_MORE_PARAMS", "Not enough parameters")
+		return
+	}
+
+	channelID := c.guildSession.channelMap.GetSnowflake(m.Params[0])
+	channel, err := c.getChannel(channelID)
+	if channelID == "" || err != nil || c.guildSessionType != guildSessionGuild || isThread(channel) {
+		c.sendFAIL(THREAD, "INVALID_TARGET", m.Params[0], "Threads can only be started in server channels")
+		return
+	}
+
+	messageID := m.Params[1]
+	if messageID == "*" {
+		messageID = ""
+	}
+
+	newThread, err := c.startThread(channelID, messageID, m.Params[2])
+	if err != nil {
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil {
+			switch restErr.Response.StatusCode {
+			case http.StatusForbidden:
+				c.sendFAIL(THREAD, "THREAD_FORBIDDEN", m.Params[0], "You're not allowed to start threads there")
+				return
+			case http.StatusNotFound:
+				c.sendFAIL(THREAD, "UNKNOWN_MSGID", m.Params[0], m.Params[1], "No such message")
+				return
+			}
+		}
+		c.sendNOTICE("There was an error starting the thread.")
+		fmt.Println(err)
+		return
+	}
+
+	// threads are only polled, so it may not be known yet
+	threadName := c.guildSession.channelMap.GetName(newThread.ID)
+	if threadName == "" {
+		threadName = c.addChannel(&newThread.Channel)
+	}
+	c.joinChannel(threadName)
+}
+
+func (c *ircConn) handleKICK(m *irc.Message) {
+	if len(m.Params) < 2 {
+		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.KICK, "Not enough parameters")
+		return
+	}
+
+	channelName := m.Params[0]
+	channelID := c.guildSession.channelMap.GetSnowflake(channelName)
+	if channelID == "" {
+		c.sendERR(irc.ERR_NOSUCHCHANNEL, channelName, "No such channel")
+		return
+	}
+	if !c.checkPermission(channelName, discordgo.PermissionKickMembers) {
+		return
+	}
+
+	var reason string
+	if len(m.Params) > 2 {
+		reason = truncate(m.Params[2], maxKickLength)
+	}
+
+	for _, nick := range strings.Split(m.Params[1], ",") {
+		userID := c.guildSession.userMap.GetSnowflake(nick)
+		if userID == "" {
+			c.sendERR(irc.ERR_NOSUCHNICK, nick, "No such nick")
+			continue
+		}
+		var err error
+		if reason != "" {
+			err = c.session.GuildMemberDeleteWithReason(c.guild.ID, userID, reason)
+		} else {
+			err = c.session.GuildMemberDelete(c.guild.ID, userID)
+		}
+		if err != nil {
+			c.sendModerationERR(err, channelName, nick)
+			continue
+		}
+		c.sendKICK(channelName, nick, reason)
+	}
+}
+
+func (c *ircConn) handleAWAY(m *irc.Message) {
+	status := discordgo.StatusOnline
+	if len(m.Params) > 0 && m.Params[0] != "" {
+		status = discordgo.Status(*awayStatus)
+	}
+
+	_, err := c.session.UserUpdateStatus(status)
+	if err != nil {
+		c.sendNOTICE("There was an error changing your status.")
+		fmt.Println(err)
+		return
+	}
+
+	if status == discordgo.StatusOnline {
+		c.sendRPL(irc.RPL_UNAWAY, "You are no longer marked as being away")
+	} else {
+		c.sendRPL(irc.RPL_NOWAWAY, "You have been marked as being away")
+	}
 }
 
 func (c *ircConn) handleCAP(m *irc.Message) {
@@ -42,7 +476,14 @@ func (c *ircConn) handleCAP(m *irc.Message) {
 	switch m.Params[0] {
 	case irc.CAP_LS:
 		c.user.capBlocked = true
-		c.sendCAP(irc.CAP_LS, strings.Join(supportedCapabilities, " "))
+		caps := []string{}
+		for _, cap := range supportedCapabilities {
+			if value, exists := capabilityValues[cap]; exists && c.user.supportsCap302 {
+				cap += "=" + value
+			}
+			caps = append(caps, cap)
+		}
+		c.sendCAP(irc.CAP_LS, strings.Join(caps, " "))
 	case irc.CAP_LIST:
 		supportedCaps := []string{}
 		for key := range c.user.supportedCapabilities {
@@ -91,20 +532,179 @@ func (c *ircConn) handleCAP(m *irc.Message) {
 	return
 }
 
+func (c *ircConn) handleAUTHENTICATE(m *irc.Message) {
+	if len(m.Params) < 1 {
+		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.AUTHENTICATE, "Not enough parameters")
+		return
+	}
+	if c.loggedin || c.user.saslAuthenticated {
+		c.sendERR(irc.ERR_SASLALREADY, "You have already authenticated using SASL")
+		return
+	}
+	if !c.user.supportedCapabilities["sasl"] {
+		c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+
+	param := m.Params[0]
+	if param == "*" {
+		c.user.saslMechanism, c.user.saslBuffer = "", ""
+		c.sendERR(irc.ERR_SASLABORTED, "SASL authentication aborted")
+		return
+	}
+
+	if c.user.saslMechanism == "" {
+		mechanism := strings.ToUpper(param)
+		if mechanism != "PLAIN" && mechanism != "EXTERNAL" {
+			c.sendRPL(irc.RPL_SASLMECHS, capabilityValues["sasl"], "are available SASL mechanisms")
+			c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed")
+			return
+		}
+		c.user.saslMechanism = mechanism
+		c.sendAUTHENTICATE("+")
+		return
+	}
+
+	if len(param) > 400 {
+		c.user.saslMechanism, c.user.saslBuffer = "", ""
+		c.sendERR(irc.ERR_SASLTOOLONG, "SASL message too long")
+		return
+	}
+	if param != "+" {
+		c.user.saslBuffer += param
+	}
+	if len(param) == 400 { // the rest of the payload is in the next message
+		return
+	}
+
+	mechanism := c.user.saslMechanism
+	payload, err := base64.StdEncoding.DecodeString(c.user.saslBuffer)
+	c.user.saslMechanism, c.user.saslBuffer = "", ""
+	if err != nil {
+		c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed")
+		return
+	}
+
+	var token, guildSelector string
+	switch mechanism {
+	case "PLAIN":
+		var ok bool
+		_, guildSelector, token, ok = parseSASLPlain(payload)
+		if !ok {
+			c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed")
+			return
+		}
+	case "EXTERNAL":
+		token = c.getCertToken()
+		if token == "" {
+			c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed: unknown client certificate")
+			return
+		}
+		guildSelector = string(payload)
+	}
+
+	// PASS is sent before CAP negotiation, so the server password is known by now. Without it,
+	// the bridge mustn't connect to Discord, or anyone could use it to try tokens.
+	if *serverPass != "" && c.user.password != *serverPass {
+		c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed: incorrect server password")
+		return
+	}
+
+	guildID := c.findGuildID(guildSelector)
+	guildSession, err := findGuildSession(token, guildID)
+	if err != nil {
+		fmt.Println(err)
+		c.sendERR(irc.ERR_SASLFAIL, "SASL authentication failed: couldn't connect to Discord")
+		return
+	}
+
+	c.user.token = token
+	c.user.guildID = guildID
+	c.user.saslAuthenticated = true
+
+	account := convertDiscordUsernameToIRCUser(guildSession.selfUser.Username)
+	mask := c.user.nick + "!" + c.user.username + "@" + c.getClientPrefix().Host
+	c.sendRPL(irc.RPL_LOGGEDIN, mask, account, "You are now logged in as "+account)
+	c.sendRPL(irc.RPL_SASLSUCCESS, "SASL authentication successful")
+}
+
+// handleBOUNCER implements soju.im/bouncer-networks, with each Discord server as a network.
+// Connections that don't BIND one get the DM session.
+func (c *ircConn) handleBOUNCER(m *irc.Message) {
+	const BOUNCER = "BOUNCER" // TODO: put in irc lib fork
+	if len(m.Params) < 1 {
+		c.sendFAIL(BOUNCER, "NEED_MORE_PARAMS", "Not enough parameters")
+		return
+	}
+
+	subcommand := strings.ToUpper(m.Params[0])
+	switch subcommand {
+	case "BIND":
+		if c.loggedin {
+			c.sendFAIL(BOUNCER, "REGISTRATION_IS_COMPLETED", "BIND", "Cannot bind a network after registration")
+			return
+		}
+		if len(m.Params) < 2 {
+			c.sendFAIL(BOUNCER, "NEED_MORE_PARAMS", "BIND", "Not enough parameters")
+			return
+		}
+		if _, err := strconv.ParseUint(m.Params[1], 10, 64); err != nil {
+			c.sendFAIL(BOUNCER, "INVALID_NETID", "BIND", m.Params[1], "Network IDs are Discord server IDs")
+			return
+		}
+		// registration fails if we're not in the server
+		c.user.networkID = m.Params[1]
+	case "LISTNETWORKS":
+		if !c.loggedin {
+			c.sendERR(irc.ERR_NOTREGISTERED, "You have not registered")
+			return
+		}
+		guilds := c.session.State.Guilds
+		if len(guilds) == 0 {
+			userGuilds, err := c.session.UserGuilds(100, "", "")
+			if err != nil {
+				c.sendNOTICE("There was an error getting your servers from Discord.")
+				fmt.Println(err)
+				return
+			}
+			for _, userGuild := range userGuilds {
+				guilds = append(guilds, &discordgo.Guild{ID: userGuild.ID, Name: userGuild.Name})
+			}
+		}
+
+		tag := uuid.New().String()
+		if c.user.supportedCapabilities["batch"] {
+			c.sendBATCH(true, tag, "soju.im/bouncer-networks")
+		}
+		for _, guild := range guilds {
+			c.sendBOUNCERNetwork(tag, guild.ID, formatAttributes([]string{"name", "state"}, map[string]string{
+				"name":  guild.Name,
+				"state": "connected", // Discord servers are always reachable
+			}))
+		}
+		if c.user.supportedCapabilities["batch"] {
+			c.sendBATCH(false, tag)
+		}
+	default:
+		c.sendFAIL(BOUNCER, "UNKNOWN_COMMAND", subcommand, "Networks are the Discord servers you're in")
+	}
+}
+
 func (c *ircConn) handleMOTD() {
 	c.sendERR(irc.ERR_NOMOTD, "MOTD file is missing")
 }
 
 func (c *ircConn) handleNICK(m *irc.Message) {
-	if c.loggedin {
-		// TODO
-		return
-	}
 	if len(m.Params) < 1 {
 		c.sendERR(irc.ERR_NONICKNAMEGIVEN, "No nickname given")
 		return
 	}
 
+	if c.loggedin {
+		c.changeNick(m.Params[0])
+		return
+	}
+
 	if false {
 		c.sendERR(irc.ERR_ERRONEUSNICKNAME, "Erroneus nickname")
 		return
@@ -118,6 +718,62 @@ func (c *ircConn) handleNICK(m *irc.Message) {
 	}
 }
 
+// changeNick sets our guild nickname, or just a local alias in the DM session
+func (c *ircConn) changeNick(nick string) {
+	oldNick := c.getNick(c.selfUser)
+	if nick == oldNick {
+		return
+	}
+
+	if !isValidDiscordNick(nick) {
+		c.sendERR(irc.ERR_ERRONEUSNICKNAME, nick, "Erroneus nickname")
+		return
+	}
+	if userID := c.guildSession.userMap.GetSnowflake(nick); userID != "" && userID != c.selfUser.ID {
+		c.sendERR(irc.ERR_NICKNAMEINUSE, nick, "Nickname is already in use")
+		return
+	}
+
+	if c.guildSessionType == guildSessionDM {
+		c.usersMutex.Lock()
+		c.guildSession.selfAlias = nick
+		c.usersMutex.Unlock()
+		c.updateUser(c.selfUser)
+	} else {
+		err := c.session.GuildMemberNickname(c.guild.ID, "@me", nick)
+		if err != nil {
+			if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil {
+				switch restErr.Response.StatusCode {
+				case http.StatusBadRequest:
+					c.sendERR(irc.ERR_ERRONEUSNICKNAME, nick, "Discord rejected that nickname")
+					return
+				case http.StatusForbidden:
+					c.sendERR(irc.ERR_ERRONEUSNICKNAME, nick, "You don't have permission to change your nickname on Discord")
+					return
+				}
+			}
+			c.sendNOTICE("There was an error changing your nickname on Discord.")
+			fmt.Println(err)
+			return
+		}
+
+		// update the cache now so the GuildMemberUpdate that follows doesn't send the NICK again
+		member := *c.selfMember
+		member.Nick = nick
+		c.selfMember = &member
+		c.updateMember(&member)
+	}
+
+	newNick := c.getNick(c.selfUser)
+	for _, conn := range c.guildSession.conns {
+		if conn == nil {
+			continue
+		}
+		conn.sendNICK(oldNick, oldNick, c.selfUser.ID, newNick)
+		conn.setClientNick(newNick)
+	}
+}
+
 func (c *ircConn) handleUSER(m *irc.Message) {
 	if c.loggedin {
 		c.sendERR(irc.ERR_ALREADYREGISTRED, irc.PASS, "You may not reregister")
@@ -158,171 +814,132 @@ func (c *ircConn) handlePASS(m *irc.Message) {
 
 func (c *ircConn) handleTOPIC(m *irc.Message) {
 	if len(m.Params) < 1 {
-		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.JOIN, "Not enough parameters")
-		return
-	}
-
-	if len(m.Params) > 1 {
-		// TODO
+		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.TOPIC, "Not enough parameters")
 		return
 	}
 
 	channelName := m.Params[0]
 
 	channelID := c.guildSession.channelMap.GetSnowflake(channelName)
+	if channelID == "" {
+		c.sendERR(irc.ERR_NOSUCHCHANNEL, channelName, "No such channel")
+		return
+	}
 
-	c.channelsMutex.Lock()
-	if !c.channels[channelID] {
-		c.channelsMutex.Unlock()
-		c.sendERR(irc.ERR_NOTONCHANNEL, "You're not on that channel")
+	if !c.isJoined(channelID) {
+		c.sendERR(irc.ERR_NOTONCHANNEL, channelName, "You're not on that channel")
 		return
 	}
-	c.channelsMutex.Unlock()
 
 	channel, err := c.getChannel(channelID)
 	if err != nil {
 		return
 	}
 
+	if len(m.Params) > 1 {
+		c.setTopic(channelName, channel, m.Params[1])
+		return
+	}
+
 	topic := convertDiscordTopicToIRC(channel.Topic, c)
 
 	if topic != "" {
+		setter, date := c.getTopicSetter(channel)
 		c.sendRPL(irc.RPL_TOPIC, channelName, topic)
-		c.sendRPL(irc.RPL_TOPICWHOTIME, channelName, "noone", "0")
+		c.sendRPL(irc.RPL_TOPICWHOTIME, channelName, setter, strconv.FormatInt(date.Unix(), 10))
+	}
+}
+
+func (c *ircConn) setTopic(channelName string, channel *discordgo.Channel, topic string) {
+	if c.guildSessionType != guildSessionGuild || c.getPermissions(c.selfMember, channel)&discordgo.PermissionManageChannels == 0 {
+		c.sendERR(irc.ERR_CHANOPRIVSNEEDED, channelName, "You need the Manage Channel permission to change the topic")
+		return
+	}
+
+	// the new topic is sent to us by Discord in a channel update
+	err := c.setChannelTopic(channel.ID, truncate(convertIRCMessageToDiscord(c, topic), maxTopicLength))
+	if err != nil {
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil && restErr.Response.StatusCode == http.StatusForbidden {
+			c.sendERR(irc.ERR_CHANOPRIVSNEEDED, channelName, "You need the Manage Channel permission to change the topic")
+			return
+		}
+		c.sendNOTICE("There was an error changing the topic.")
+		fmt.Println(err)
 	}
 }
 
 func (c *ircConn) handleJOIN(m *irc.Message) {
-	// TODO: rewrite
 	if len(m.Params) < 1 {
 		c.sendERR(irc.ERR_NEEDMOREPARAMS, irc.JOIN, "Not enough parameters")
 		return
 	}
 
-	channelID := c.guildSession.channelMap.GetSnowflake(m.Params[0])
+	var channelNames []string
+	if m.Params[0] == "*" {
+		for channelName := range c.guildSession.channelMap.GetSnowflakeMap() {
+			channelNames = append(channelNames, channelName)
+		}
+	} else {
+		channelNames = strings.Split(m.Params[0], ",")
+	}
+
+	for _, channelName := range channelNames {
+		c.joinChannel(channelName)
+	}
+}
+
+func (c *ircConn) joinChannel(channelName string) {
+	discordChannelID := c.guildSession.channelMap.GetSnowflake(channelName)
+	if discordChannelID == "" {
+		c.sendERR(irc.ERR_NOSUCHCHANNEL, channelName, "No such channel")
+		return
+	}
 
 	c.channelsMutex.Lock()
-	if c.channels[channelID] {
+	if c.channels[discordChannelID] {
 		// user already on channel
 		c.channelsMutex.Unlock()
 		return
 	}
 	c.channelsMutex.Unlock()
-	//Lord Forgive me for what i'm about to do
-	//TODO: Fix this asap its utter shit also note to self learn fucking go to avoid this.
-	if m.Params[0] == "*" {
-        for channelName := range c.guildSession.channelMap.GetSnowflakeMap() {
-            discordChannelID := c.guildSession.channelMap.GetSnowflake(channelName)
-            if discordChannelID == "" {
-                c.sendERR(irc.ERR_NOSUCHCHANNEL, channelName, "No such channel")
-                continue
-            }
-
-            discordChannel, err := c.getChannel(discordChannelID)
-            if err != nil {
-                c.sendNOTICE(fmt.Sprint(err))
-                fmt.Println("error fetching channel data")
-                continue
-            }
-
-            c.channelsMutex.Lock()
-            c.channels[discordChannelID] = true
-            c.channelsMutex.Unlock()
-
-            c.sendJOIN("", "", "", channelName)
-
-            go c.handleTOPIC(&irc.Message{
-                Command: irc.TOPIC,
-                Params:  []string{channelName},
-            })
-
-            go func(c *ircConn, channel *discordgo.Channel) {
-                messages, err := c.session.ChannelMessages(channel.ID, 100, "", "", "")
-                if err != nil {
-                    c.sendNOTICE("There was an error getting messages from Discord.")
-                    return
-                }
-
-                channelName := c.guildSession.channelMap.GetName(channel.ID)
-                if channelName == "" {
-                    c.sendNOTICE("This shouldn't happen (1). If you see this, report it as a bug.")
-                    return
-                }
-
-                tag := uuid.New().String()
-                if c.user.supportedCapabilities["batch"] {
-                    c.sendBATCH(true, tag, "chathistory", channelName)
-                }
-                for i := len(messages); i != 0; i-- { // Discord sends them in reverse order
-                    date, err := messages[i-1].Timestamp.Parse()
-                    if err != nil {
-                        continue
-                    }
-                    sendMessageFromDiscordToIRC(date, c, messages[i-1], "", tag)
-                }
-                if c.user.supportedCapabilities["batch"] {
-                    c.sendBATCH(false, tag)
-                }
-            }(c, discordChannel)
-            go c.handleNAMES(&irc.Message{Command: irc.NAMES, Params: []string{channelName}})
-        }
-	} else {
-        for _, channelName := range strings.Split(m.Params[0], ",") {
-            discordChannelID := c.guildSession.channelMap.GetSnowflake(channelName)
-            if discordChannelID == "" {
-                c.sendERR(irc.ERR_NOSUCHCHANNEL, channelName, "No such channel")
-                continue
-            }
-
-            discordChannel, err := c.getChannel(discordChannelID)
-            if err != nil {
-                c.sendNOTICE(fmt.Sprint(err))
-                fmt.Println("error fetching channel data")
-                continue
-            }
-
-            c.channelsMutex.Lock()
-            c.channels[discordChannelID] = true
-            c.channelsMutex.Unlock()
-
-            c.sendJOIN("", "", "", channelName)
-
-            go c.handleTOPIC(&irc.Message{
-                Command: irc.TOPIC,
-                Params:  []string{channelName},
-            })
-
-            go func(c *ircConn, channel *discordgo.Channel) {
-                messages, err := c.session.ChannelMessages(channel.ID, 100, "", "", "")
-                if err != nil {
-                    c.sendNOTICE("There was an error getting messages from Discord.")
-                    return
-                }
-
-                channelName := c.guildSession.channelMap.GetName(channel.ID)
-                if channelName == "" {
-                    c.sendNOTICE("This shouldn't happen (1). If you see this, report it as a bug.")
-                    return
-                }
-
-                tag := uuid.New().String()
-                if c.user.supportedCapabilities["batch"] {
-                    c.sendBATCH(true, tag, "chathistory", channelName)
-                }
-                for i := len(messages); i != 0; i-- { // Discord sends them in reverse order
-                    date, err := messages[i-1].Timestamp.Parse()
-                    if err != nil {
-                        continue
-                    }
-                    sendMessageFromDiscordToIRC(date, c, messages[i-1], "", tag)
-                }
-                if c.user.supportedCapabilities["batch"] {
-                    c.sendBATCH(false, tag)
-                }
-            }(c, discordChannel)
-            go c.handleNAMES(&irc.Message{Command: irc.NAMES, Params: []string{channelName}})
-        }
+
+	discordChannel, err := c.getChannel(discordChannelID)
+	if err != nil {
+		c.sendNOTICE(fmt.Sprint(err))
+		fmt.Println("error fetching channel data")
+		return
+	}
+
+	c.channelsMutex.Lock()
+	c.channels[discordChannelID] = true
+	c.channelsMutex.Unlock()
+
+	c.sendJOIN("", "", "", channelName)
+
+	go c.handleTOPIC(&irc.Message{
+		Command: irc.TOPIC,
+		Params:  []string{channelName},
+	})
+
+	// clients with chathistory ask for as much as they want themselves
+	if !c.user.supportedCapabilities["draft/chathistory"] {
+		go func(c *ircConn, channel *discordgo.Channel) {
+			messages, err := c.getHistoryBefore(channel.ID, "", "", 100)
+			if err != nil {
+				c.sendNOTICE("There was an error getting messages from Discord.")
+				return
+			}
+
+			channelName := c.guildSession.channelMap.GetName(channel.ID)
+			if channelName == "" {
+				c.sendNOTICE("This shouldn't happen (1). If you see this, report it as a bug.")
+				return
+			}
+
+			sendMessagesFromDiscordToIRC(c, channelName, messages)
+		}(c, discordChannel)
 	}
+	go c.handleNAMES(&irc.Message{Command: irc.NAMES, Params: []string{channelName}})
 }
 
 func (c *ircConn) handlePART(m *irc.Message) {
@@ -368,71 +985,119 @@ func (c *ircConn) handlePONG(m *irc.Message) {
 	c.lastPONG = m.Params[0]
 }
 
+// namesTimeout is how long NAMES waits for the next member chunk before giving up
+const namesTimeout = 10 * time.Second
+
 func (c *ircConn) handleNAMES(m *irc.Message) {
 	if len(m.Params) < 1 {
 		c.sendRPL(irc.RPL_ENDOFNAMES, "*", "End of /NAMES list")
 		return
 	}
-	var ircNickArray []string
+	channelName := m.Params[0]
+	channelID := c.guildSession.channelMap.GetSnowflake(channelName)
+	if channelID == "" {
+		c.sendRPL(irc.RPL_ENDOFNAMES, channelName, "End of /NAMES list")
+		return
+	}
+
+	// start waiting before the first reply so we can't miss a chunk in between
+	var membersChunks chan struct{}
 	if c.guildSessionType == guildSessionGuild {
-		for c.guildSession.membersDone == false {
-			time.Sleep(5 * time.Second)
-		}
-		ircNicks := c.guildSession.userMap.GetSnowflakeMap()
-		ircNickArray = []string{}
-		for nick := range ircNicks {
-			ircNickArray = append(ircNickArray, nick)
+		membersChunks = c.guildSession.waitForMembers()
+		if membersChunks != nil {
+			defer c.guildSession.stopWaitingForMembers(membersChunks)
 		}
-	} else if c.guildSessionType == guildSessionDM {
-		ircNickArray = []string{}
-		channelID := c.guildSession.channelMap.GetSnowflake(m.Params[0])
-		channel, err := c.getChannel(channelID)
-		if err != nil {
-			// TODO: error
-			return
+	}
+
+	sent := make(map[string]bool)
+	c.sendNAMREPLY(channelName, channelID, sent)
+	timeout := time.NewTimer(namesTimeout)
+	defer timeout.Stop()
+	for membersChunks != nil {
+		select {
+		case _, ok := <-membersChunks:
+			if !ok {
+				membersChunks = nil
+			}
+			c.sendNAMREPLY(channelName, channelID, sent)
+			if !timeout.Stop() {
+				<-timeout.C
+			}
+			timeout.Reset(namesTimeout)
+		case <-timeout.C:
+			membersChunks = nil
 		}
-		for _, user := range channel.Recipients {
-			ircNickArray = append(ircNickArray, c.getNick(user))
+	}
+
+	c.sendRPL(irc.RPL_ENDOFNAMES, channelName, "End of /NAMES list")
+}
+
+// sendNAMREPLY sends the users in a channel who aren't in sent yet, and adds them to it
+func (c *ircConn) sendNAMREPLY(channelName string, channelID string, sent map[string]bool) {
+	channel, err := c.getChannel(channelID)
+	if err != nil {
+		channel = nil
+	}
+	var ircNickArray []string
+	for _, user := range c.getChannelUsers(channelID) {
+		if sent[user.ID] {
+			continue
 		}
-		ircNickArray = append(ircNickArray, c.getNick(c.selfUser))
+		sent[user.ID] = true
+		ircNickArray = append(ircNickArray, getMembershipPrefix(c.getUserModes(channel, user.ID))+c.getNick(user))
 	}
-	done := false
-	for i := 0; !done; {
+	for len(ircNickArray) > 0 {
 		_ircNicks := []string{}
-		for len(strings.Join(_ircNicks, " ")) < 400 {
-			if i >= len(ircNickArray) {
-				done = true
-				break
-			}
-			nick := ircNickArray[i]
-			_ircNicks = append(_ircNicks, nick)
-			i++
+		for len(ircNickArray) > 0 && len(strings.Join(_ircNicks, " ")) < 400 {
+			_ircNicks = append(_ircNicks, ircNickArray[0])
+			ircNickArray = ircNickArray[1:]
 		}
-		c.sendRPL(irc.RPL_NAMREPLY, "=", m.Params[0], strings.Join(_ircNicks, " "))
+		c.sendRPL(irc.RPL_NAMREPLY, "=", channelName, strings.Join(_ircNicks, " "))
 	}
-
-	c.sendRPL(irc.RPL_ENDOFNAMES, m.Params[0], "End of /NAMES list")
 }
 
 func (c *ircConn) handleLIST(m *irc.Message) {
-	if len(m.Params) > 0 && m.Params[0] != "" {
-		// TODO
-		return
+	query := parseListQuery("")
+	if len(m.Params) > 0 {
+		query = parseListQuery(m.Params[0])
 	}
+
+	channels := c.getSortedChannels()
+	userCounts := c.getChannelUserCounts(channels)
 	c.sendRPL(irc.RPL_LISTSTART, "Channels", "Users  Name")
-	for ircChannel, discordChannelID := range c.guildSession.channelMap.GetSnowflakeMap() {
-		discordChannel, err := c.getChannel(discordChannelID)
-		if err != nil {
-			c.sendNOTICE(fmt.Sprint(err))
-			fmt.Println("error getting channel")
+	for _, discordChannel := range channels {
+		if c.guildSessionType == guildSessionGuild && !c.canView(c.selfMember, discordChannel) {
+			continue
+		}
+		ircChannel := c.getChannelName(discordChannel)
+		if ircChannel == "" {
+			// voice, stage and category channels can't be joined, so they aren't in the channelMap
+			switch discordChannel.Type {
+			case discordgo.ChannelTypeGuildVoice, channelTypeGuildStageVoice, discordgo.ChannelTypeGuildCategory:
+				if !*listAllChannels {
+					continue
+				}
+			default:
+				continue
+			}
+			ircChannel = convertDiscordChannelNameToIRC(discordChannel.Name)
+		}
+
+		users := userCounts[discordChannel.ID]
+		topic := convertDiscordTopicToIRC(discordChannel.Topic, c)
+		var topicSet time.Time
+		if query.hasTopicAge() {
+			_, topicSet = c.getTopicSetter(discordChannel)
+		}
+		if !query.match(ircChannel, topic, users, getTimeFromSnowflake(discordChannel.ID), topicSet) {
 			continue
 		}
 
 		c.sendRPL(
 			irc.RPL_LIST,
 			ircChannel,
-			strconv.Itoa(c.guildSession.userMap.Length()),
-			convertDiscordTopicToIRC(discordChannel.Topic, c),
+			strconv.Itoa(users),
+			c.getChannelMarkers(discordChannel)+topic,
 		)
 	}
 	c.sendRPL(irc.RPL_LISTEND, "End of /LIST")
@@ -448,21 +1113,370 @@ func (c *ircConn) handlePRIVMSG(m *irc.Message) {
 		return
 	}
 
-	channel := c.guildSession.channelMap.GetSnowflake(m.Params[0])
+	channel, err := c.getTargetChannel(m.Params[0])
+	if err != nil {
+		c.sendNOTICE("There was an error opening a DM with " + m.Params[0] + ".")
+		fmt.Println(err)
+		return
+	}
+	if channel == "" && c.guildSessionType == guildSessionGuild && !strings.HasPrefix(m.Params[0], "#") {
+		c.sendERR(irc.ERR_NOSUCHNICK, m.Params[0], "No such nick")
+		return
+	}
 	if channel == "" {
 		c.sendERR(irc.ERR_NOSUCHCHANNEL, m.Params[0], "No such channel")
 		return
 	}
 
+	if edit := parseSedEdit(m.Params[1]); edit != nil {
+		c.editOwnMessage(m, channel, edit)
+		return
+	}
+
 	content := convertIRCMessageToDiscord(c, m.Params[1])
+	replyID := getTag(m, "+draft/reply")
+	if utf8.RuneCountInString(content) > maxDiscordMessageLength {
+		c.sendLongMessage(channel, replyID, content)
+		return
+	}
+	c.sendMessage(channel, replyID, content)
+}
 
-	addRecentlySentMessage(c, channel, content)
+// sendMessage sends a message to Discord, returning false if that failed
+func (c *ircConn) sendMessage(channel string, replyID string, content string) bool {
+	sent := addRecentlySentMessage(c, channel, content)
 
-	_, err := c.session.ChannelMessageSend(channel, content)
+	var message *discordgo.Message
+	var err error
+	if replyID != "" {
+		message, err = c.sendReply(channel, replyID, content)
+	} else {
+		message, err = c.session.ChannelMessageSend(channel, content)
+	}
 	if err != nil {
 		// TODO: map common discord errors to irc errors
 		c.sendNOTICE("There was an error sending your message.")
 		fmt.Println(err)
+		return false
+	}
+	setRecentlySentMessageID(c, sent, message.ID)
+	return true
+}
+
+// sendLongMessage sends a message that's over Discord's length limit. It's split into a few messages,
+// or uploaded as a file if it's a code block, which splitting would break, or it needs too many.
+func (c *ircConn) sendLongMessage(channel string, replyID string, content string) {
+	parts := splitDiscordMessage(content, maxDiscordMessageLength)
+	isCode := strings.HasPrefix(content, "```") && strings.HasSuffix(content, "```")
+	if !isCode && len(parts) <= maxPasteMessages {
+		for i, part := range parts {
+			if i > 0 {
+				replyID = ""
+			}
+			if !c.sendMessage(channel, replyID, part) {
+				return
+			}
+		}
+		return
+	}
+
+	if isCode {
+		content = strings.TrimSuffix(strings.TrimPrefix(content, "```"), "```")
+		content = strings.Trim(patternCodeLanguage.ReplaceAllString(content, ""), "\n")
+	}
+	sent := addRecentlySentMessage(c, channel, "")
+	message, err := c.sendFile(channel, replyID, "paste.txt", strings.NewReader(content))
+	if err != nil {
+		c.sendNOTICE("There was an error uploading your message.")
+		fmt.Println(err)
+		return
+	}
+	setRecentlySentMessageID(c, sent, message.ID)
+}
+
+// handleBATCH handles draft/multiline batches, which are sent to Discord as one message
+func (c *ircConn) handleBATCH(m *irc.Message) {
+	if len(m.Params) < 1 || len(m.Params[0]) < 2 {
+		c.sendERR(irc.ERR_NEEDMOREPARAMS, "BATCH", "Not enough parameters")
+		return
+	}
+	reference := m.Params[0][1:]
+
+	if strings.HasPrefix(m.Params[0], "+") {
+		if len(m.Params) < 3 || m.Params[1] != "draft/multiline" {
+			c.sendFAIL("BATCH", "INVALID_TYPE", "Only draft/multiline batches are supported")
+			return
+		}
+		if len(c.multilineBatches) >= maxMultilineBatches {
+			c.sendFAIL("BATCH", "MULTILINE_INVALID", "Too many multiline batches are open")
+			return
+		}
+		c.multilineBatches[reference] = &multilineBatch{start: m}
+		return
+	}
+
+	batch, exists := c.multilineBatches[reference]
+	if !exists {
+		c.sendFAIL("BATCH", "INVALID_REFTAG", reference, "Unknown batch")
+		return
+	}
+	delete(c.multilineBatches, reference)
+	if batch.fail != nil {
+		c.sendFAIL("BATCH", batch.fail[0], batch.fail[1:]...)
+		return
+	}
+
+	go c.handlePRIVMSG(&irc.Message{
+		Tags:    batch.start.Tags,
+		Command: irc.PRIVMSG,
+		Params:  []string{batch.start.Params[2], batch.text.String()},
+	})
+}
+
+// editOwnMessage applies a s/pattern/replacement/ correction to one of our own messages.
+// If it can't be applied, the user is told why and the line isn't sent.
+func (c *ircConn) editOwnMessage(m *irc.Message, channel string, edit *sedEdit) {
+	reference := edit.reference
+	if reference == "" {
+		reference = getTag(m, "+draft/reply")
+	}
+
+	messageID := getOwnMessageID(c, channel, reference)
+	if messageID == "" {
+		c.sendNOTICE("Couldn't find a recent message of yours to edit.")
+		return
+	}
+
+	message, err := c.getMessage(channel, messageID)
+	if err != nil {
+		c.sendNOTICE("There was an error getting your message from Discord.")
+		fmt.Println(err)
+		return
+	}
+
+	content, ok := edit.apply(message.Content)
+	if !ok {
+		c.sendNOTICE(fmt.Sprintf("Couldn't find \"%s\" in your message.", edit.pattern))
+		return
+	}
+
+	_, err = c.session.ChannelMessageEdit(channel, messageID, content)
+	if err != nil {
+		c.sendNOTICE("There was an error editing your message.")
+		fmt.Println(err)
+	}
+}
+
+func (c *ircConn) handleTAGMSG(m *irc.Message) {
+	if len(m.Params) < 1 {
+		c.sendERR(irc.ERR_NORECIPIENT, "No recipient given (TAGMSG)")
+		return
+	}
+
+	messageID := getTag(m, "+draft/reply")
+	react := getTag(m, "+draft/react")
+	unreact := getTag(m, "+draft/unreact")
+	if messageID == "" || (react == "" && unreact == "") {
+		// typing notifications and other client tags aren't bridged
+		return
+	}
+
+	channel, err := c.getTargetChannel(m.Params[0])
+	if err != nil {
+		c.sendNOTICE("There was an error opening a DM with " + m.Params[0] + ".")
+		fmt.Println(err)
+		return
+	}
+	if channel == "" {
+		c.sendERR(irc.ERR_NOSUCHCHANNEL, m.Params[0], "No such channel")
+		return
+	}
+
+	if react != "" {
+		err = c.session.MessageReactionAdd(channel, messageID, convertIRCEmojiToDiscord(c, react))
+	} else {
+		err = c.session.MessageReactionRemove(channel, messageID, convertIRCEmojiToDiscord(c, unreact), "@me")
+	}
+	if err != nil {
+		c.sendNOTICE("There was an error sending your reaction.")
+		fmt.Println(err)
+		return
+	}
+}
+
+func (c *ircConn) handleREDACT(m *irc.Message) {
+	const REDACT = "REDACT" // TODO: put in irc lib fork
+	if len(m.Params) < 2 {
+		c.sendFAIL(REDACT, "NEED_MORE_PARAMS", "Not enough parameters")
+		return
+	}
+
+	channel, err := c.getTargetChannel(m.Params[0])
+	if err != nil {
+		c.sendFAIL(REDACT, "UNKNOWN_ERROR", m.Params[0], m.Params[1], "There was an error opening a DM")
+		fmt.Println(err)
+		return
+	}
+	if channel == "" {
+		c.sendFAIL(REDACT, "INVALID_TARGET", m.Params[0], "No such channel")
+		return
+	}
+
+	err = c.session.ChannelMessageDelete(channel, m.Params[1])
+	if err != nil {
+		if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Response != nil {
+			switch restErr.Response.StatusCode {
+			case http.StatusForbidden:
+				c.sendFAIL(REDACT, "REDACT_FORBIDDEN", m.Params[0], m.Params[1], "You're not allowed to delete that message")
+				return
+			case http.StatusNotFound:
+				c.sendFAIL(REDACT, "UNKNOWN_MSGID", m.Params[0], m.Params[1], "No such message")
+				return
+			}
+		}
+		c.sendFAIL(REDACT, "UNKNOWN_ERROR", m.Params[0], m.Params[1], "There was an error deleting the message")
+		fmt.Println(err)
+		return
+	}
+}
+
+// parseHistoryReference returns the snowflake for a CHATHISTORY msgid=, timestamp= or * reference
+func parseHistoryReference(reference string) (snowflake string, ok bool) {
+	if reference == "*" {
+		return "", true
+	}
+	if strings.HasPrefix(reference, "msgid=") {
+		snowflake = strings.TrimPrefix(reference, "msgid=")
+		_, err := strconv.ParseUint(snowflake, 10, 64)
+		return snowflake, err == nil
+	}
+	if strings.HasPrefix(reference, "timestamp=") {
+		date, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(reference, "timestamp="))
+		if err != nil {
+			return "", false
+		}
+		return getSnowflakeFromTime(date), true
+	}
+	return "", false
+}
+
+func (c *ircConn) handleCHATHISTORY(m *irc.Message) {
+	const CHATHISTORY = "CHATHISTORY" // TODO: put in irc lib fork
+	if len(m.Params) < 4 {
+		c.sendFAIL(CHATHISTORY, "NEED_MORE_PARAMS", "Not enough parameters")
+		return
+	}
+
+	subcommand := strings.ToUpper(m.Params[0])
+	limit, err := strconv.Atoi(m.Params[len(m.Params)-1])
+	if err != nil || limit < 1 {
+		c.sendFAIL(CHATHISTORY, "INVALID_PARAMS", subcommand, "Invalid limit")
+		return
+	}
+	if limit > maxChatHistory {
+		limit = maxChatHistory
+	}
+
+	if subcommand == "TARGETS" {
+		c.handleCHATHISTORYTargets(m.Params[1], m.Params[2], limit)
+		return
+	}
+
+	target := m.Params[1]
+	channelID, err := c.getTargetChannel(target)
+	if err != nil {
+		c.sendFAIL(CHATHISTORY, "MESSAGE_ERROR", subcommand, target, "There was an error opening a DM")
+		fmt.Println(err)
+		return
+	}
+	if channelID == "" {
+		c.sendFAIL(CHATHISTORY, "INVALID_TARGET", subcommand, target, "No such channel")
+		return
+	}
+
+	reference, ok := parseHistoryReference(m.Params[2])
+	if !ok || (reference == "" && subcommand != "LATEST") {
+		c.sendFAIL(CHATHISTORY, "INVALID_PARAMS", subcommand, m.Params[2], "Invalid message reference")
+		return
+	}
+
+	var messages []*discordgo.Message
+	switch subcommand {
+	case "LATEST":
+		messages, err = c.getHistoryBefore(channelID, "", reference, limit)
+	case "BEFORE":
+		messages, err = c.getHistoryBefore(channelID, reference, "", limit)
+	case "AFTER":
+		messages, err = c.getHistoryAfter(channelID, reference, "", limit)
+	case "AROUND":
+		messages, err = c.getHistoryAround(channelID, reference, limit)
+	case "BETWEEN":
+		if len(m.Params) < 5 {
+			c.sendFAIL(CHATHISTORY, "NEED_MORE_PARAMS", subcommand, "Not enough parameters")
+			return
+		}
+		bound, ok := parseHistoryReference(m.Params[3])
+		if !ok || bound == "" {
+			c.sendFAIL(CHATHISTORY, "INVALID_PARAMS", subcommand, m.Params[3], "Invalid message reference")
+			return
+		}
+		if snowflakeLess(reference, bound) {
+			messages, err = c.getHistoryAfter(channelID, reference, bound, limit)
+		} else {
+			messages, err = c.getHistoryBefore(channelID, reference, bound, limit)
+		}
+	default:
+		c.sendFAIL(CHATHISTORY, "INVALID_PARAMS", subcommand, "Unknown subcommand")
+		return
+	}
+	if err != nil {
+		c.sendFAIL(CHATHISTORY, "MESSAGE_ERROR", subcommand, target, "There was an error getting messages from Discord")
+		fmt.Println(err)
+		return
+	}
+
+	sendMessagesFromDiscordToIRC(c, target, messages)
+}
+
+// handleCHATHISTORYTargets lists the channels with messages between two timestamps
+func (c *ircConn) handleCHATHISTORYTargets(from string, to string, limit int) {
+	const CHATHISTORY = "CHATHISTORY" // TODO: put in irc lib fork
+	start, ok := parseHistoryReference(from)
+	end, ok2 := parseHistoryReference(to)
+	if !ok || !ok2 || !strings.HasPrefix(from, "timestamp=") || !strings.HasPrefix(to, "timestamp=") {
+		c.sendFAIL(CHATHISTORY, "INVALID_PARAMS", "TARGETS", "Invalid timestamp")
 		return
 	}
+	if snowflakeLess(end, start) {
+		start, end = end, start
+	}
+
+	channels := []*discordgo.Channel{}
+	for channelID := range c.guildSession.channelMap.GetNameMap() {
+		channel, err := c.getChannel(channelID)
+		if err != nil || channel.LastMessageID == "" {
+			continue
+		}
+		if snowflakeLess(channel.LastMessageID, start) || snowflakeLess(end, channel.LastMessageID) {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return snowflakeLess(channels[i].LastMessageID, channels[j].LastMessageID)
+	})
+	if len(channels) > limit {
+		channels = channels[:limit]
+	}
+
+	tag := uuid.New().String()
+	if c.user.supportedCapabilities["batch"] {
+		c.sendBATCH(true, tag, "draft/chathistory-targets")
+	}
+	for _, channel := range channels {
+		c.sendCHATHISTORYTarget(tag, c.getChannelName(channel), getTimeFromSnowflake(channel.LastMessageID))
+	}
+	if c.user.supportedCapabilities["batch"] {
+		c.sendBATCH(false, tag)
+	}
 }
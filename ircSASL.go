@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"os"
+	"strings"
+)
+
+// certTokens maps TLS client certificate fingerprints to Discord tokens for SASL EXTERNAL
+var certTokens = map[string]string{}
+
+// loadCertTokens reads a file of `<sha256 fingerprint> <token>` lines
+func loadCertTokens(filename string) (err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		fingerprint := strings.ToLower(strings.Replace(fields[0], ":", "", -1))
+		certTokens[fingerprint] = fields[1]
+	}
+	return scanner.Err()
+}
+
+// getCertToken returns the token stored for the client's TLS certificate, if it sent one
+func (c *ircConn) getCertToken() string {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) < 1 {
+		return ""
+	}
+	fingerprint := sha256.Sum256(certificates[0].Raw)
+	return certTokens[hex.EncodeToString(fingerprint[:])]
+}
+
+// parseSASLPlain splits a PLAIN payload into authzid, authcid and password
+func parseSASLPlain(payload []byte) (authzid string, authcid string, password string, ok bool) {
+	fields := strings.Split(string(payload), "\x00")
+	if len(fields) != 3 {
+		return "", "", "", false
+	}
+	return fields[0], fields[1], fields[2], true
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"github.com/tadeokondrak/irc"
 )
 
@@ -8,15 +10,25 @@ func (c *ircConn) sendNOTICE(message string) (err error) {
 	err = c.encode(&irc.Message{
 		Prefix:  &c.serverPrefix,
 		Command: irc.NOTICE,
-		Params:  append([]string{c.clientPrefix.Name}, message),
+		Params:  append([]string{c.getClientPrefix().Name}, message),
 	})
 	return
 }
+func (c *ircConn) sendFAIL(command string, code string, params ...string) (err error) {
+	FAIL := "FAIL" // TODO: put in irc lib fork
+	err = c.encode(&irc.Message{
+		Prefix:  &c.serverPrefix,
+		Command: FAIL,
+		Params:  append([]string{command, code}, params...),
+	})
+	return
+}
+
 func (c *ircConn) sendERR(command string, params ...string) (err error) {
 	err = c.encode(&irc.Message{
 		Prefix:  &c.serverPrefix,
 		Command: command,
-		Params:  append([]string{c.clientPrefix.Name}, params...),
+		Params:  append([]string{c.getClientPrefix().Name}, params...),
 	})
 	return
 }
@@ -25,7 +37,7 @@ func (c *ircConn) sendRPL(command string, params ...string) (err error) {
 	err = c.encode(&irc.Message{
 		Prefix:  &c.serverPrefix,
 		Command: command,
-		Params:  append([]string{c.clientPrefix.Name}, params...),
+		Params:  append([]string{c.getClientPrefix().Name}, params...),
 	})
 	return
 }
@@ -33,7 +45,7 @@ func (c *ircConn) sendRPL(command string, params ...string) (err error) {
 func (c *ircConn) sendJOIN(nick string, realname string, hostname string, target string) (err error) {
 	var prefix *irc.Prefix
 	if nick == "" || realname == "" || hostname == "" {
-		prefix = &c.clientPrefix
+		prefix = c.getClientPrefix()
 	} else {
 		prefix = &irc.Prefix{
 			User: nick,
@@ -52,7 +64,7 @@ func (c *ircConn) sendJOIN(nick string, realname string, hostname string, target
 func (c *ircConn) sendPART(nick string, realname string, hostname string, target string, reason string) (err error) {
 	var prefix *irc.Prefix
 	if nick == "" || realname == "" || hostname == "" {
-		prefix = &c.clientPrefix
+		prefix = c.getClientPrefix()
 	} else {
 		prefix = &irc.Prefix{
 			User: nick,
@@ -118,6 +130,17 @@ func (c *ircConn) sendPRIVMSG(tags irc.Tags, nick string, realname string, hostn
 	if content == "" {
 		content = " "
 	}
+	return c.encode(c.getPRIVMSG(tags, nick, realname, hostname, target, content))
+}
+
+// getPRIVMSGLength returns how many bytes of content fit in a PRIVMSG. The irc library cuts
+// messages off at 512 bytes including their tags.
+func (c *ircConn) getPRIVMSGLength(tags irc.Tags, nick string, realname string, hostname string, target string) int {
+	return maxLineLength - len("\r\n") - len(c.getPRIVMSG(tags, nick, realname, hostname, target, "").Bytes())
+}
+
+// getPRIVMSG builds a PRIVMSG with the tags the client supports
+func (c *ircConn) getPRIVMSG(tags irc.Tags, nick string, realname string, hostname string, target string, content string) *irc.Message {
 	_tags := irc.Tags{}
 
 	// TODO: clean up
@@ -129,6 +152,18 @@ func (c *ircConn) sendPRIVMSG(tags irc.Tags, nick string, realname string, hostn
 		_tags["batch"] = tags["batch"]
 	}
 
+	if c.user.supportedCapabilities["message-tags"] && tags["msgid"] != "" {
+		_tags["msgid"] = tags["msgid"]
+	}
+
+	if c.user.supportedCapabilities["message-tags"] && tags["+draft/reply"] != "" {
+		_tags["+draft/reply"] = tags["+draft/reply"]
+	}
+
+	if _, concat := tags["draft/multiline-concat"]; c.user.supportedCapabilities["draft/multiline"] && concat {
+		_tags["draft/multiline-concat"] = ""
+	}
+
 	var prefix *irc.Prefix
 	if nick == "" || realname == "" || hostname == "" {
 		prefix = &c.serverPrefix
@@ -139,27 +174,159 @@ func (c *ircConn) sendPRIVMSG(tags irc.Tags, nick string, realname string, hostn
 			Host: hostname,
 		}
 	}
-	if len(_tags) == 0 {
-		err = c.encode(&irc.Message{
-			Prefix:  prefix,
-			Command: irc.PRIVMSG,
-			Params:  []string{target, content},
-		})
+	message := &irc.Message{
+		Prefix:  prefix,
+		Command: irc.PRIVMSG,
+		Params:  []string{target, content},
+	}
+	if len(_tags) > 0 {
+		message.Tags = &_tags
+	}
+	return message
+}
+
+// sendMultilineBATCH starts a draft/multiline batch, which has the source and tags its PRIVMSGs would have had
+func (c *ircConn) sendMultilineBATCH(tags irc.Tags, nick string, realname string, hostname string, batchTag string, target string) (err error) {
+	BATCH := "BATCH" // TODO: put in irc lib fork
+	message := c.getPRIVMSG(tags, nick, realname, hostname, target, "")
+	message.Command = BATCH
+	message.Params = []string{"+" + batchTag, "draft/multiline", target}
+	return c.encode(message)
+}
+
+func (c *ircConn) sendTAGMSG(tags irc.Tags, nick string, realname string, hostname string, target string) (err error) {
+	TAGMSG := "TAGMSG" // TODO: put in irc lib fork
+	if !c.user.supportedCapabilities["message-tags"] {
+		return
+	}
+	_tags := irc.Tags{}
+	for key, value := range tags {
+		if key == "time" && !c.user.supportedCapabilities["server-time"] {
+			continue
+		}
+		if key == "batch" && !c.user.supportedCapabilities["batch"] {
+			continue
+		}
+		_tags[key] = value
+	}
+
+	var prefix *irc.Prefix
+	if nick == "" || realname == "" || hostname == "" {
+		prefix = c.getClientPrefix()
+	} else {
+		prefix = &irc.Prefix{
+			User: nick,
+			Name: realname,
+			Host: hostname,
+		}
+	}
+	err = c.encode(&irc.Message{
+		Tags:    &_tags,
+		Prefix:  prefix,
+		Command: TAGMSG,
+		Params:  []string{target},
+	})
+	return
+}
+
+func (c *ircConn) sendChannelNOTICE(nick string, realname string, hostname string, target string, content string) (err error) {
+	var prefix *irc.Prefix
+	if nick == "" || realname == "" || hostname == "" {
+		prefix = &c.serverPrefix
+	} else {
+		prefix = &irc.Prefix{
+			User: nick,
+			Name: realname,
+			Host: hostname,
+		}
+	}
+	err = c.encode(&irc.Message{
+		Prefix:  prefix,
+		Command: irc.NOTICE,
+		Params:  []string{target, content},
+	})
+	return
+}
+
+func (c *ircConn) sendREDACT(target string, messageID string) (err error) {
+	REDACT := "REDACT" // TODO: put in irc lib fork
+	// Discord doesn't tell us who deleted a message, so it comes from the server
+	err = c.encode(&irc.Message{
+		Prefix:  &c.serverPrefix,
+		Command: REDACT,
+		Params:  []string{target, messageID},
+	})
+	return
+}
+
+func (c *ircConn) sendAWAY(nick string, realname string, hostname string, message string) (err error) {
+	var prefix *irc.Prefix
+	if nick == "" || realname == "" || hostname == "" {
+		prefix = c.getClientPrefix()
+	} else {
+		prefix = &irc.Prefix{
+			User: nick,
+			Name: realname,
+			Host: hostname,
+		}
+	}
+	params := []string{}
+	if message != "" {
+		params = append(params, message)
+	}
+	err = c.encode(&irc.Message{
+		Prefix:  prefix,
+		Command: irc.AWAY,
+		Params:  params,
+	})
+	return
+}
+
+func (c *ircConn) sendTOPIC(nick string, realname string, hostname string, target string, topic string) (err error) {
+	var prefix *irc.Prefix
+	if nick == "" || realname == "" || hostname == "" {
+		prefix = &c.serverPrefix
 	} else {
-		err = c.encode(&irc.Message{
-			Tags:    &_tags,
-			Prefix:  prefix,
-			Command: irc.PRIVMSG,
-			Params:  []string{target, content},
-		})
+		prefix = &irc.Prefix{
+			User: nick,
+			Name: realname,
+			Host: hostname,
+		}
 	}
+	err = c.encode(&irc.Message{
+		Prefix:  prefix,
+		Command: irc.TOPIC,
+		Params:  []string{target, topic},
+	})
+	return
+}
+
+func (c *ircConn) sendKICK(target string, nick string, reason string) (err error) {
+	params := []string{target, nick}
+	if reason != "" {
+		params = append(params, reason)
+	}
+	err = c.encode(&irc.Message{
+		Prefix:  c.getClientPrefix(),
+		Command: irc.KICK,
+		Params:  params,
+	})
+	return
+}
+
+func (c *ircConn) sendMODE(target string, modes string, params ...string) (err error) {
+	err = c.encode(&irc.Message{
+		Prefix:  &c.serverPrefix,
+		Command: irc.MODE,
+		Params:  append([]string{target, modes}, params...),
+	})
 	return
 }
 
 func (c *ircConn) sendQUIT(nick string, realname string, hostname string, reason string) (err error) {
 	var prefix *irc.Prefix
 	if nick == "" || realname == "" || hostname == "" {
-		prefix = &c.clientPrefix
+		prefix = c.getClientPrefix()
 	} else {
 		prefix = &irc.Prefix{
 			User: nick,
@@ -188,6 +355,14 @@ func (c *ircConn) sendCAP(subcommand string, params ...string) (err error) {
 	return
 }
 
+func (c *ircConn) sendAUTHENTICATE(message string) (err error) {
+	err = c.encode(&irc.Message{
+		Command: irc.AUTHENTICATE,
+		Params:  []string{message},
+	})
+	return
+}
+
 func (c *ircConn) sendBATCH(start bool, tag string, params ...string) (err error) {
 	BATCH := "BATCH" // TODO: put in irc lib fork
 	prefix := "+"
@@ -202,3 +377,31 @@ func (c *ircConn) sendBATCH(start bool, tag string, params ...string) (err error
 	})
 	return
 }
+
+func (c *ircConn) sendBOUNCERNetwork(batchTag string, networkID string, attributes string) (err error) {
+	BOUNCER := "BOUNCER" // TODO: put in irc lib fork
+	message := &irc.Message{
+		Prefix:  &c.serverPrefix,
+		Command: BOUNCER,
+		Params:  []string{"NETWORK", networkID, attributes},
+	}
+	if c.user.supportedCapabilities["batch"] && batchTag != "" {
+		message.Tags = &irc.Tags{"batch": batchTag}
+	}
+	err = c.encode(message)
+	return
+}
+
+func (c *ircConn) sendCHATHISTORYTarget(batchTag string, target string, date time.Time) (err error) {
+	CHATHISTORY := "CHATHISTORY" // TODO: put in irc lib fork
+	message := &irc.Message{
+		Prefix:  &c.serverPrefix,
+		Command: CHATHISTORY,
+		Params:  []string{"TARGETS", target, "timestamp=" + date.UTC().Format("2006-01-02T15:04:05.000Z")},
+	}
+	if c.user.supportedCapabilities["batch"] && batchTag != "" {
+		message.Tags = &irc.Tags{"batch": batchTag}
+	}
+	err = c.encode(message)
+	return
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReplaceMentions(t *testing.T) {
+	pattern := regexp.MustCompile("<@[^>]*>")
+	replace := func(mention string, restore string) string {
+		return "\x0f\x0302\x02@nick" + restore
+	}
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hi <@1>", "hi \x0f\x0302\x02@nick\x0f"},
+		{"in bold", "\x02hi <@1> there\x02", "\x02hi \x0f\x0302\x02@nick\x0f\x02 there\x02"},
+		{"in colour", "\x0304hi <@1> there", "\x0304hi \x0f\x0302\x02@nick\x0f\x0304 there"},
+		{"before digits", "\x0304<@1>1", "\x0304\x0f\x0302\x02@nick\x0f\x0304\x02\x021"},
+		{"after a reset", "\x02\x1dhi\x0f <@1>", "\x02\x1dhi\x0f \x0f\x0302\x02@nick\x0f"},
+		{"on the next line", "\x02hi\n<@1>", "\x02hi\n\x0f\x0302\x02@nick\x0f"},
+		{"two", "\x1d<@1> <@2>", "\x1d\x0f\x0302\x02@nick\x0f\x1d \x0f\x0302\x02@nick\x0f\x1d"},
+	}
+	for _, test := range tests {
+		if got := replaceMentions(test.in, pattern, replace); got != test.want {
+			t.Errorf("%s: replaceMentions(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestListQueryTopicAge(t *testing.T) {
+	now := time.Now()
+	created := now.Add(-24 * time.Hour)
+	tests := []struct {
+		param    string
+		topicSet time.Time
+		want     bool
+	}{
+		{"T<60", now.Add(-30 * time.Minute), true},
+		{"T<60", now.Add(-90 * time.Minute), false},
+		{"T>60", now.Add(-90 * time.Minute), true},
+		{"T>60", now.Add(-30 * time.Minute), false},
+		{"#dev*,T<60", now.Add(-30 * time.Minute), true},
+		{"T:*rules*", time.Time{}, true},
+	}
+	for _, test := range tests {
+		query := parseListQuery(test.param)
+		if got := query.match("#dev", "the rules", 5, created, test.topicSet); got != test.want {
+			t.Errorf("parseListQuery(%q).match(topic set %v ago) = %v, want %v", test.param, now.Sub(test.topicSet), got, test.want)
+		}
+	}
+}
+
+func TestSplitIRCLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		maxBytes int
+		concat   bool
+		want     []string
+	}{
+		{"fits", "hi ", 10, false, []string{"hi "}},
+		{"between words", "ab cd ef", 5, false, []string{"ab", "cd ef"}},
+		{"trailing space", "ab cd ", 4, false, []string{"ab", "cd"}},
+		{"multibyte rune at the boundary", "aé", 2, false, []string{"a", "é"}},
+		{"colour code at the boundary", "abcdef\x0304,05gh", 10, false, []string{"abcdef", "\x0304,05gh"}},
+		{"colour carried over", "\x0304,05abcd wxyz", 14, false, []string{"\x0304,05abcd", "\x0304,05wxyz"}},
+		{"bold and italic carried over", "\x02\x1dbold text", 8, false, []string{"\x02\x1dbold", "\x02\x1dtext"}},
+		{"reset isn't carried over", "\x02a\x0f b", 3, false, []string{"\x02a\x0f", "b"}},
+		{"word longer than maxBytes", "abcdefghij", 4, false, []string{"abcd", "efgh", "ij"}},
+		{"concat keeps spaces", "ab cd ef", 5, true, []string{"ab ", "cd ef"}},
+		{"concat keeps trailing space", "ab cd ", 4, true, []string{"ab ", "cd "}},
+		{"concat doesn't repeat formatting", "\x02\x1dbold text", 8, true, []string{"\x02\x1dbold ", "text"}},
+	}
+	for _, test := range tests {
+		got := splitIRCLine(test.line, test.maxBytes, test.concat)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitIRCLine(%q, %d, %v) = %q, want %q", test.name, test.line, test.maxBytes, test.concat, got, test.want)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 const (
 	version = "0.0.0.0a" // TODO: update
 	serverhostname = "GentooInc"
+	maxChatHistory = 500 // Discord only returns 100 per request, so this is a few requests at most
 )
 
 var (
@@ -26,6 +27,17 @@ var (
 		"server-time",
 		"batch",
 		"echo-message",
+		"message-tags",
+		"draft/chathistory",
+		"draft/message-redaction",
+		"sasl",
+		"away-notify",
+		"soju.im/bouncer-networks",
+		"draft/multiline",
+	}
+	capabilityValues = map[string]string{ // sent with CAP LS 302
+		"sasl":            "PLAIN,EXTERNAL",
+		"draft/multiline": "max-bytes=" + strconv.Itoa(maxMultilineBytes) + ",max-lines=" + strconv.Itoa(maxMultilineLines),
 	}
 	discordSessions      = map[string]*discordgo.Session{}
 	discordSessionsMutex = sync.Mutex{}
@@ -46,9 +58,13 @@ func handleConnection(conn net.Conn) {
 			User: "*",
 			Host: clientHostname,
 		},
-		recentlySentMessages: make(map[string][]string),
+		recentlySentMessages: make(map[string][]*sentMessage),
 		conn:                 conn,
 		channels:             make(map[string]bool),
+		queries:              make(map[string]string),
+		multilineBatches:     make(map[string]*multilineBatch),
+		pastes:               make(map[string]*paste),
+		pasteSends:           make(map[string]chan struct{}),
 		channelsMutex:        sync.RWMutex{},
 		user: ircUser{
 			nick:                  "*",
@@ -85,6 +101,12 @@ func handleConnection(conn net.Conn) {
 		case irc.NICK:
 			c.handleNICK(message)
 			continue
+		case irc.AUTHENTICATE:
+			c.handleAUTHENTICATE(message)
+			continue
+		case "BOUNCER":
+			c.handleBOUNCER(message)
+			continue
 		case irc.PING:
 			go c.handlePING(message)
 			continue
@@ -94,13 +116,35 @@ func handleConnection(conn net.Conn) {
 		}
 
 		if c.loggedin {
+			// batches are handled here rather than in goroutines, so their messages stay in order
+			if message.Command == "BATCH" {
+				c.handleBATCH(message)
+				continue
+			}
+			if c.addToBatch(message) {
+				continue
+			}
+
 			switch message.Command {
 
 			case irc.JOIN:
 				go c.handleJOIN(message)
 				continue
 			case irc.PRIVMSG:
-				go c.handlePRIVMSG(message)
+				if *pasteWindow > 0 {
+					c.bufferPRIVMSG(message)
+				} else {
+					go c.handlePRIVMSG(message)
+				}
+				continue
+			case "TAGMSG":
+				go c.handleTAGMSG(message)
+				continue
+			case "REDACT":
+				go c.handleREDACT(message)
+				continue
+			case "CHATHISTORY":
+				go c.handleCHATHISTORY(message)
 				continue
 			case irc.LIST:
 				go c.handleLIST(message)
@@ -114,13 +158,36 @@ func handleConnection(conn net.Conn) {
 			case irc.WHOIS:
 				go c.handleWHOIS(message)
 				continue
+			case irc.WHO:
+				go c.handleWHO(message)
+				continue
+			case irc.TOPIC:
+				go c.handleTOPIC(message)
+				continue
+			case "THREAD":
+				go c.handleTHREAD(message)
+				continue
+			case irc.KICK:
+				go c.handleKICK(message)
+				continue
+			case irc.MODE:
+				go c.handleMODE(message)
+				continue
+			case irc.AWAY:
+				go c.handleAWAY(message)
+				continue
 			}
 		}
 	}
 }
 
 var (
-	serverPass = flag.String("serverpassword", "", "Server password that must also be specified when logging in.")
+	serverPass      = flag.String("serverpassword", "", "Server password that must also be specified when logging in.")
+	awayStatus      = flag.String("awaystatus", "idle", "Discord status to set when you mark yourself away: idle or dnd.")
+	timeoutDuration = flag.Duration("timeout", time.Hour, "How long to time out Discord members for when they're quieted with MODE +q. At most 28 days.")
+	listAllChannels = flag.Bool("listall", false, "Also show voice, stage and category channels in LIST.")
+	pasteWindow     = flag.Duration("pastewindow", 0, "Lines sent to the same channel or nick within this long of each other are sent to Discord as one message, e.g. 500ms. Each line is delayed by this long. Disabled by default.")
+	reactionFormat  = flag.String("reactionformat", "$nick reacted $emoji to: $message", "NOTICE sent for reactions to clients without message-tags. $nick, $emoji and $message are replaced. Leave empty to disable.")
 )
 
 func main() {
@@ -129,12 +196,31 @@ func main() {
 	address := flag.String("address", "127.0.0.1", "Address to listen on. Set to \"0.0.0.0\" to listen on all interfaces, leave default if you're connecting from the same computer as the server (localhost/127.0.0.1).")
 	certfile := flag.String("certfile", "", "For TLS: certificate file.")
 	keyfile := flag.String("keyfile", "", "For TLS: key file.")
+	certTokensFile := flag.String("certtokens", "", "For TLS: file of \"<client certificate sha256 fingerprint> <discord token>\" lines, used for SASL EXTERNAL.")
 	flag.Parse()
 
+	if *awayStatus != string(discordgo.StatusIdle) && *awayStatus != string(discordgo.StatusDoNotDisturb) {
+		log.Fatalln("awaystatus must be idle or dnd")
+	}
+
+	if *timeoutDuration <= 0 || *timeoutDuration > 28*24*time.Hour {
+		log.Fatalln("timeout must be between 0 and 28 days")
+	}
+
+	if *pasteWindow < 0 {
+		log.Fatalln("pastewindow can't be negative")
+	}
+
 	if *tlsEnabled && (*certfile == "" || *keyfile == "") {
 		log.Fatalln("certfile and keyfile must be specified if tls is enabled")
 	}
 
+	if *certTokensFile != "" {
+		if err := loadCertTokens(*certTokensFile); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	port := strconv.Itoa(*portFlag)
 
 	var err error
@@ -144,7 +230,10 @@ func main() {
 		if err != nil {
 			log.Fatalln(err)
 		}
-		server, err = tls.Listen("tcp", *address+":"+port, &tls.Config{Certificates: []tls.Certificate{cert}})
+		server, err = tls.Listen("tcp", *address+":"+port, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequestClientCert, // for SASL EXTERNAL
+		})
 	} else {
 		server, err = net.Listen("tcp", *address+":"+port)
 	}
@@ -154,6 +243,7 @@ func main() {
 	}
 
 	go pingPongLoop()
+	go threadPollLoop()
 	defer server.Close()
 	for {
 		conn, err := server.Accept()
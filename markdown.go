@@ -0,0 +1,398 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// mIRC formatting codes
+const (
+	formatBold          = "\x02"
+	formatColour        = "\x03"
+	formatHexColour     = "\x04"
+	formatReset         = "\x0f"
+	formatMonospace     = "\x11"
+	formatReverse       = "\x16"
+	formatItalic        = "\x1d"
+	formatStrikethrough = "\x1e"
+	formatUnderline     = "\x1f"
+	formatSpoiler       = "\x0301,01" // black on black
+	formatQuote         = "\x0314>\x03 "
+)
+
+// markdownDelimiters are Discord's inline formatting delimiters and their mIRC codes, longest first
+var markdownDelimiters = []struct {
+	delimiter string
+	code      string
+}{
+	{"**", formatBold},
+	{"__", formatUnderline},
+	{"~~", formatStrikethrough},
+	{"||", formatSpoiler},
+	{"*", formatItalic},
+	{"_", formatItalic},
+}
+
+var (
+	// URLs and <@mentions>, <#channels>, <:emoji:> and <t:timestamps> aren't Markdown
+	patternMarkdownAtom = regexp.MustCompile(`^(?:https?://[^\s<]+|<(?:[@#]|a?:|t:)[^>\s]*>)`)
+	patternCodeLanguage = regexp.MustCompile(`^[A-Za-z0-9+#-]+\n`)
+	patternColourCode   = regexp.MustCompile(`^[0-9]{1,2}(?:,[0-9]{1,2})?`)
+	patternHexColour    = regexp.MustCompile(`^[0-9A-Fa-f]{6}(?:,[0-9A-Fa-f]{6})?`)
+)
+
+// markdownConverter turns Discord Markdown into mIRC formatting
+type markdownConverter struct {
+	out      strings.Builder
+	active   []string // codes in effect, which are applied again after each newline
+	quoteAll bool     // after >>>, every line is quoted
+}
+
+// convertDiscordMarkdownToIRC turns Discord Markdown into mIRC formatting codes
+func convertDiscordMarkdownToIRC(text string) string {
+	var converter markdownConverter
+	converter.convert(text, true)
+	return converter.out.String()
+}
+
+// convert writes text to out. Quotes can only start at the top level.
+func (m *markdownConverter) convert(text string, topLevel bool) {
+	for i := 0; i < len(text); {
+		if topLevel && (i == 0 || text[i-1] == '\n') {
+			i += m.quote(text[i:])
+			if i >= len(text) {
+				break
+			}
+		}
+
+		rest := text[i:]
+		switch {
+		case rest[0] == '\\' && len(rest) > 1 && isMarkdownPunctuation(rest[1]):
+			m.out.WriteByte(rest[1])
+			i += 2
+			continue
+		case rest[0] == '\n':
+			m.newline()
+			i++
+			continue
+		case rest[0] == '`':
+			if n := m.code(rest); n > 0 {
+				i += n
+				continue
+			}
+			run := len(rest) - len(strings.TrimLeft(rest, "`"))
+			m.out.WriteString(rest[:run])
+			i += run
+			continue
+		}
+
+		if atom := patternMarkdownAtom.FindString(rest); atom != "" {
+			m.out.WriteString(atom)
+			i += len(atom)
+			continue
+		}
+
+		if n := m.delimited(text, i); n > 0 {
+			i += n
+			continue
+		}
+
+		m.out.WriteByte(rest[0])
+		i++
+	}
+}
+
+func (m *markdownConverter) newline() {
+	m.out.WriteString("\n" + strings.Join(m.active, ""))
+}
+
+// quote writes the quote marker for a line and returns how much of it was the Markdown for it
+func (m *markdownConverter) quote(line string) int {
+	switch {
+	case m.quoteAll:
+		m.out.WriteString(formatQuote)
+		return 0
+	case strings.HasPrefix(line, ">>> "):
+		m.quoteAll = true
+		m.out.WriteString(formatQuote)
+		return 4
+	case strings.HasPrefix(line, "> "):
+		m.out.WriteString(formatQuote)
+		return 2
+	}
+	return 0
+}
+
+// code writes the inline code or code block at the start of text and returns its length,
+// or 0 if it isn't closed
+func (m *markdownConverter) code(text string) int {
+	if strings.HasPrefix(text, "```") {
+		end := strings.Index(text[3:], "```")
+		if end < 0 {
+			return 0
+		}
+		content := text[3 : 3+end]
+		length := 3 + end + 3
+		if !strings.Contains(content, "\n") {
+			m.out.WriteString(formatMonospace + content + formatMonospace)
+			return length
+		}
+
+		// code blocks get lines of their own
+		content = strings.TrimPrefix(patternCodeLanguage.ReplaceAllString(content, ""), "\n")
+		content = strings.TrimSuffix(content, "\n")
+		if out := m.out.String(); out != "" && !strings.HasSuffix(out, "\n") {
+			m.newline()
+		}
+		for i, line := range strings.Split(content, "\n") {
+			if i > 0 {
+				m.newline()
+			}
+			m.out.WriteString(formatMonospace + line + formatMonospace)
+		}
+		if length < len(text) && text[length] != '\n' {
+			m.newline()
+		}
+		return length
+	}
+
+	// inline code is closed by the same number of backticks
+	run := len(text) - len(strings.TrimLeft(text, "`"))
+	for i := run; i < len(text); {
+		closing := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+		if closing == run && i > run {
+			m.out.WriteString(formatMonospace + strings.TrimSpace(text[run:i]) + formatMonospace)
+			return i + run
+		}
+		if closing == 0 {
+			closing = 1
+		}
+		i += closing
+	}
+	return 0
+}
+
+// delimited writes the formatted span starting at text[i] and returns its length, or 0 if there isn't one
+func (m *markdownConverter) delimited(text string, i int) int {
+	for _, d := range markdownDelimiters {
+		if !strings.HasPrefix(text[i:], d.delimiter) || !canOpenMarkdown(text, i, d.delimiter) {
+			continue
+		}
+		start := i + len(d.delimiter)
+		end := findMarkdownCloser(text, start, d.delimiter)
+		if end < 0 {
+			continue
+		}
+
+		after := end + len(d.delimiter)
+		m.format(d.code, text[start:end], text[after:])
+		return after - i
+	}
+	return 0
+}
+
+// format writes inner with a formatting code applied
+func (m *markdownConverter) format(code string, inner string, following string) {
+	for _, active := range m.active {
+		if active == code { // toggling it again would turn it off
+			m.convert(inner, false)
+			return
+		}
+	}
+
+	m.out.WriteString(code)
+	m.active = append(m.active, code)
+	m.convert(inner, false)
+	m.active = m.active[:len(m.active)-1]
+
+	if !strings.HasPrefix(code, formatColour) {
+		m.out.WriteString(code)
+		return
+	}
+	m.out.WriteString(formatColour)
+	if following != "" && (following[0] == ',' || (following[0] >= '0' && following[0] <= '9')) {
+		// so it isn't read as part of the colour code
+		m.out.WriteString(formatBold + formatBold)
+	}
+}
+
+func canOpenMarkdown(text string, i int, delimiter string) bool {
+	next := i + len(delimiter)
+	switch delimiter {
+	case "*":
+		return next < len(text) && !unicode.IsSpace(rune(text[next]))
+	case "_":
+		return i == 0 || !isWordByte(text[i-1])
+	}
+	return true
+}
+
+func canCloseMarkdown(text string, k int, delimiter string) bool {
+	next := k + len(delimiter)
+	switch delimiter {
+	case "**":
+		return next >= len(text) || text[next] != '*'
+	case "__":
+		return next >= len(text) || text[next] != '_'
+	case "*":
+		return !unicode.IsSpace(rune(text[k-1]))
+	case "_":
+		return next >= len(text) || !isWordByte(text[next])
+	}
+	return true
+}
+
+// findMarkdownCloser returns where the span opened before start is closed, or -1
+func findMarkdownCloser(text string, start int, delimiter string) int {
+	for k := start; k < len(text); k++ {
+		switch {
+		case text[k] == '\\':
+			k++
+		case (delimiter == "*" && strings.HasPrefix(text[k:], "**")) || (delimiter == "_" && strings.HasPrefix(text[k:], "__")):
+			k++ // bold or underline inside italics
+		case k > start && strings.HasPrefix(text[k:], delimiter) && canCloseMarkdown(text, k, delimiter):
+			return k
+		}
+	}
+	return -1
+}
+
+func isMarkdownPunctuation(b byte) bool {
+	return b < 0x80 && unicode.IsPunct(rune(b)) || b == '`' || b == '|' || b == '~' || b == '>' || b == '<'
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= '0' && b <= '9') || (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z')
+}
+
+// IRC formatting that has a Markdown equivalent, in the order it's opened
+const (
+	ircBold = 1 << iota
+	ircItalic
+	ircUnderline
+	ircStrikethrough
+	ircMonospace
+)
+
+var ircFormatMarkdown = []struct {
+	format int
+	marker string
+}{
+	{ircBold, "**"},
+	{ircItalic, "*"},
+	{ircUnderline, "__"},
+	{ircStrikethrough, "~~"},
+	{ircMonospace, "`"},
+}
+
+// convertIRCFormattingToMarkdown turns mIRC formatting codes into Discord Markdown, dropping colours
+func convertIRCFormattingToMarkdown(text string) string {
+	type segment struct {
+		text   string
+		format int
+	}
+	var segments []segment
+	var current strings.Builder
+	format := 0
+	toggle := func(f int) {
+		if current.Len() > 0 {
+			if n := len(segments); n > 0 && segments[n-1].format == format {
+				segments[n-1].text += current.String()
+			} else {
+				segments = append(segments, segment{current.String(), format})
+			}
+			current.Reset()
+		}
+		format ^= f
+	}
+
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case formatBold[0]:
+			toggle(ircBold)
+		case formatItalic[0]:
+			toggle(ircItalic)
+		case formatUnderline[0]:
+			toggle(ircUnderline)
+		case formatStrikethrough[0]:
+			toggle(ircStrikethrough)
+		case formatMonospace[0]:
+			toggle(ircMonospace)
+		case formatReset[0]:
+			toggle(format)
+		case formatColour[0]:
+			i += len(patternColourCode.FindString(text[i+1:]))
+		case formatHexColour[0]:
+			i += len(patternHexColour.FindString(text[i+1:]))
+		case formatReverse[0]:
+		default:
+			current.WriteByte(text[i])
+		}
+	}
+	toggle(0)
+
+	// Markdown has to be closed in the order it was opened
+	var builder strings.Builder
+	var open []int
+	openFormat := 0
+	closeTo := func(keep int) {
+		for j, f := range open {
+			if keep&f != 0 {
+				continue
+			}
+			for k := len(open) - 1; k >= j; k-- {
+				builder.WriteString(getIRCFormatMarker(open[k]))
+				openFormat &^= open[k]
+			}
+			open = open[:j]
+			return
+		}
+	}
+	openTo := func(format int) {
+		for _, f := range ircFormatMarkdown {
+			if format&f.format != 0 && openFormat&f.format == 0 {
+				builder.WriteString(f.marker)
+				open = append(open, f.format)
+				openFormat |= f.format
+			}
+		}
+	}
+
+	for n, s := range segments {
+		format := s.format
+		if strings.Contains(s.text, "`") {
+			format &^= ircMonospace
+		}
+		next := 0
+		if n+1 < len(segments) {
+			next = segments[n+1].format
+		}
+
+		// Markdown inside code is literal, and Discord doesn't format spans that start or end with spaces
+		if openFormat&ircMonospace != 0 && openFormat != format {
+			closeTo(format &^ ircMonospace)
+		}
+		closeTo(format)
+		trimmed := strings.TrimLeftFunc(s.text, unicode.IsSpace)
+		builder.WriteString(s.text[:len(s.text)-len(trimmed)])
+		core := strings.TrimRightFunc(trimmed, unicode.IsSpace)
+		if core != "" {
+			openTo(format)
+			builder.WriteString(core)
+		}
+		closeTo(next)
+		builder.WriteString(trimmed[len(core):])
+	}
+	closeTo(0)
+	return builder.String()
+}
+
+func getIRCFormatMarker(format int) string {
+	for _, f := range ircFormatMarkdown {
+		if f.format == format {
+			return f.marker
+		}
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func TestConvertDiscordMarkdownToIRC(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bold", "**bold**", "\x02bold\x02"},
+		{"italic", "*italic* and _italic_", "\x1ditalic\x1d and \x1ditalic\x1d"},
+		{"underline", "__underline__", "\x1funderline\x1f"},
+		{"strikethrough", "~~strike~~", "\x1estrike\x1e"},
+		{"spoiler", "||spoiler||", "\x0301,01spoiler\x03"},
+		{"bold italic", "***bold italic***", "\x02\x1dbold italic\x1d\x02"},
+		{"nested", "**bold *italic* bold**", "\x02bold \x1ditalic\x1d bold\x02"},
+		{"nested same format", "_a *b* c_", "\x1da b c\x1d"},
+		{"unclosed", "**unclosed", "**unclosed"},
+		{"italic closed by a space", "*not italic *", "*not italic *"},
+		{"italic opened by a space", "* not italic*", "* not italic*"},
+		{"underscores in words", "snake_case_name", "snake_case_name"},
+		{"escaped", `\*escaped\*`, "*escaped*"},
+		{"escaped backslash", `\\*italic*`, "\\\x1ditalic\x1d"},
+		{"inline code", "`code **not bold**`", "\x11code **not bold**\x11"},
+		{"inline code with backticks", "``a ` b``", "\x11a ` b\x11"},
+		{"unclosed code", "`code", "`code"},
+		{"one line code block", "before ```x``` after", "before \x11x\x11 after"},
+		{"code block", "```go\nfunc main() {}\n```", "\x11func main() {}\x11"},
+		{"code block in text", "text ```\nline1\nline2\n``` after", "text \n\x11line1\x11\n\x11line2\x11\n after"},
+		{"quote", "> quote\nnot quote", "\x0314>\x03 quote\nnot quote"},
+		{"block quote", ">>> all\nquoted", "\x0314>\x03 all\n\x0314>\x03 quoted"},
+		{"formatting across lines", "**bold\nnext line**", "\x02bold\n\x02next line\x02"},
+		{"mention", "<@123> **x**", "<@123> \x02x\x02"},
+		{"url", "https://example.com/a_b_c", "https://example.com/a_b_c"},
+		{"colour before digits", "||spoiler||1", "\x0301,01spoiler\x03\x02\x021"},
+	}
+	for _, test := range tests {
+		if got := convertDiscordMarkdownToIRC(test.in); got != test.want {
+			t.Errorf("%s: convertDiscordMarkdownToIRC(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
+
+func TestConvertIRCFormattingToMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bold", "\x02bold\x02", "**bold**"},
+		{"italic", "\x1ditalic\x1d", "*italic*"},
+		{"underline", "\x1funderline\x1f", "__underline__"},
+		{"strikethrough", "\x1estrike\x1e", "~~strike~~"},
+		{"monospace", "\x11code\x11", "`code`"},
+		{"nested", "\x02\x1dboth\x1d\x02", "***both***"},
+		{"closed out of order", "\x02bold \x1dboth\x02 italic\x1d", "**bold *both*** *italic*"},
+		{"unclosed", "\x02unclosed", "**unclosed**"},
+		{"toggled off and on", "\x02a\x02\x02b\x02", "**ab**"},
+		{"empty", "\x02\x02empty", "empty"},
+		{"reset", "\x02bold\x1d both\x0f plain", "**bold *both*** plain"},
+		{"colours dropped", "\x0304red\x03 text \x0304,05red\x03", "red text red"},
+		{"hex colours dropped", "\x04FF0000hex\x04", "hex"},
+		{"reverse dropped", "\x16reverse\x16", "reverse"},
+		{"spaces outside", "\x02 spaced \x02", " **spaced** "},
+		{"backticks in code", "\x11a`b\x11", "a`b"},
+	}
+	for _, test := range tests {
+		if got := convertIRCFormattingToMarkdown(test.in); got != test.want {
+			t.Errorf("%s: convertIRCFormattingToMarkdown(%q) = %q, want %q", test.name, test.in, got, test.want)
+		}
+	}
+}
@@ -27,12 +27,13 @@ import (
 	"sync"
 )
 
-// SnowflakeMap is a bidirectional map from a string to a discord snowflake (also a string)
+// SnowflakeMap is a bidirectional map from a string to a discord snowflake (also a string).
+// Names are compared case-insensitively in ASCII, like IRC's ascii casemapping.
 type SnowflakeMap struct {
 	mu         sync.Mutex
 	separator  string
 	names      map[string]string // map[snowflake]name
-	snowflakes map[string]string // map[name]snowflake
+	snowflakes map[string]string // map[folded name]snowflake
 }
 
 // NewSnowflakeMap returns a SnowflakeMap
@@ -56,23 +57,25 @@ func (m *SnowflakeMap) Add(name string, snowflake string) string {
 			suffix = m.separator + strconv.Itoa(i)
 		}
 		_name := name + suffix
+		key := foldName(_name)
 
-		_, nameExists := m.snowflakes[_name]
+		_, nameExists := m.snowflakes[key]
 		_, snowflakeExists := m.names[snowflake]
 		if nameExists {
-			if snowflakeExists && m.snowflakes[_name] == snowflake && m.names[snowflake] == _name {
+			if snowflakeExists && m.snowflakes[key] == snowflake {
+				m.names[snowflake] = _name // its case may have changed
 				return _name
 			}
 			continue
 		} else if snowflakeExists {
 			oldName := m.names[snowflake]
-			delete(m.snowflakes, oldName)
-			m.snowflakes[_name] = snowflake
+			delete(m.snowflakes, foldName(oldName))
+			m.snowflakes[key] = snowflake
 			m.names[snowflake] = _name
 			return _name
 		}
 
-		m.snowflakes[_name] = snowflake
+		m.snowflakes[key] = snowflake
 		m.names[snowflake] = _name
 		return _name
 	}
@@ -100,27 +103,31 @@ func (m *SnowflakeMap) GetNameMap() map[string]string {
 func (m *SnowflakeMap) GetSnowflake(name string) string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	name, exists := m.snowflakes[name]
+	name, exists := m.snowflakes[foldName(name)]
 	if exists {
 		return name
 	}
 	return ""
 }
 
-// GetSnowflakeMap returns a map of snowflakes to names
+// GetSnowflakeMap returns a map of names to snowflakes
 func (m *SnowflakeMap) GetSnowflakeMap() map[string]string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return m.snowflakes
+	snowflakes := make(map[string]string, len(m.names))
+	for snowflake, name := range m.names {
+		snowflakes[name] = snowflake
+	}
+	return snowflakes
 }
 
 // RemoveName removes an entry corresponding to a name
 func (m *SnowflakeMap) RemoveName(name string) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if snowflake, exists := m.snowflakes[name]; exists {
+	if snowflake, exists := m.snowflakes[foldName(name)]; exists {
 		delete(m.names, snowflake)
-		delete(m.snowflakes, name)
+		delete(m.snowflakes, foldName(name))
 	}
 }
 
@@ -130,7 +137,7 @@ func (m *SnowflakeMap) RemoveSnowflake(snowflake string) {
 	defer m.mu.Unlock()
 	if name, exists := m.names[snowflake]; exists {
 		delete(m.names, snowflake)
-		delete(m.snowflakes, name)
+		delete(m.snowflakes, foldName(name))
 	}
 }
 
@@ -140,3 +147,14 @@ func (m *SnowflakeMap) Length() int {
 	defer m.mu.Unlock()
 	return len(m.names)
 }
+
+// foldName lowercases the ASCII letters of a name
+func foldName(name string) string {
+	folded := []byte(name)
+	for i, b := range folded {
+		if b >= 'A' && b <= 'Z' {
+			folded[i] = b + 'a' - 'A'
+		}
+	}
+	return string(folded)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"strings"
 )
 
 func truncate(str string, chars int) string {
@@ -11,21 +11,38 @@ func truncate(str string, chars int) string {
 	return str
 }
 
-func splitSubN(s string, n int) []string {
-	sub := ""
-	subs := []string{}
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
 
-	runes := bytes.Runes([]byte(s))
-	l := len(runes)
-	for i, r := range runes {
-		sub = sub + string(r)
-		if (i+1)%n == 0 {
-			subs = append(subs, sub)
-			sub = ""
-		} else if (i + 1) == l {
-			subs = append(subs, sub)
+// matchMask matches an IRC mask with * and ? wildcards, ignoring case.
+// When a match fails it only backtracks to the last *, so it takes linear time per *.
+func matchMask(mask string, s string) bool {
+	m := []rune(strings.ToLower(mask))
+	r := []rune(strings.ToLower(s))
+	i, j := 0, 0
+	star, starMatch := -1, 0 // position of the last * in the mask, and where in s it started matching
+	for j < len(r) {
+		switch {
+		case i < len(m) && (m[i] == '?' || m[i] == r[j]):
+			i++
+			j++
+		case i < len(m) && m[i] == '*':
+			star, starMatch = i, j
+			i++
+		case star >= 0:
+			// let the last * match one more character and try again from there
+			starMatch++
+			i, j = star+1, starMatch
+		default:
+			return false
 		}
 	}
-
-	return subs
+	for i < len(m) && m[i] == '*' {
+		i++
+	}
+	return i == len(m)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchMask(t *testing.T) {
+	tests := []struct {
+		mask string
+		s    string
+		want bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"#dev*", "#dev-chat", true},
+		{"#dev*", "#general", false},
+		{"#DEV*", "#dev", true},
+		{"?", "é", true},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbx", false},
+		{"a*b*c", "abbbcbc", true},
+		{"**", "x", true},
+		{"*?", "", false},
+	}
+	for _, test := range tests {
+		if got := matchMask(test.mask, test.s); got != test.want {
+			t.Errorf("matchMask(%q, %q) = %v, want %v", test.mask, test.s, got, test.want)
+		}
+	}
+}
+
+func TestMatchMaskPathological(t *testing.T) {
+	mask := strings.Repeat("*a", 8) + "b"
+	s := strings.Repeat("a", 1024)
+	start := time.Now()
+	if matchMask(mask, s) {
+		t.Errorf("matchMask(%q, %d a's) = true, want false", mask, len(s))
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("matchMask took %v", elapsed)
+	}
+}